@@ -0,0 +1,190 @@
+package assembler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Assembler assembles programs that may be spread across several files.
+type Assembler struct {
+	IncludePaths []string          // Directories searched by .include and .incbin
+	sources      map[string]string // Text of each file read, for diagnostics
+}
+
+// Assemble tokenizes, expands macros in, parses and encodes source. Files
+// it includes are looked for relative to the working directory, then on
+// no include path.
+func Assemble(source string) (*Program, error) {
+	return (&Assembler{}).Assemble("", source)
+}
+
+// AssembleFile assembles the source file at path.
+func (a *Assembler) AssembleFile(path string) (*Program, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return a.Assemble(path, string(source))
+}
+
+// Assemble assembles source, naming it file in diagnostics. file may be
+// empty for source that did not come from a file. Each stage carries on
+// past errors so that one run reports as many as it can; the error
+// returned is then an ErrorList.
+func (a *Assembler) Assemble(file string, source string) (*Program, error) {
+	a.sources = make(map[string]string)
+	var errs ErrorList
+	var stack []string
+	if file != "" {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, abs)
+	}
+	tokens := a.include(file, source, stack, &errs)
+	tokens, err := Expand(tokens)
+	if err != nil {
+		errs.add(Pos{File: file}, err)
+	}
+	parser := NewParser(tokens)
+	instructions, data, err := parser.Parse()
+	if err != nil {
+		errs.add(Pos{File: file}, err)
+	}
+	// Encoding errors from half-parsed code would mostly be noise.
+	var program *Program
+	if len(errs) == 0 {
+		program, err = Encode(parser.Sections(), instructions, data)
+		if err != nil {
+			errs.add(Pos{File: file}, err)
+		}
+	}
+	if len(errs) > 0 {
+		errs.attachSource(a.sources)
+		return nil, errs
+	}
+	return program, nil
+}
+
+// include tokenizes source and splices in the files it names:
+//
+//	.include "file.s"                 assemble file.s here
+//	.incbin "file.bin" [, skip [, n]] place the file's bytes here
+//
+// Names are looked up next to the including file, then on each include
+// path in order. stack holds the files being included, outermost first,
+// so a file that includes itself is reported rather than looping.
+func (a *Assembler) include(file string, source string, stack []string, errs *ErrorList) []Token {
+	a.sources[file] = source
+	tokens := Tokenize(source)
+	var out []Token
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		tok.Pos.File = file
+		if tok.Type != TokenDirective || (tok.Value != ".include" && tok.Value != ".incbin") {
+			out = append(out, tok)
+			continue
+		}
+		args, end := arguments(tokens, i+1)
+		if i+1 >= len(tokens) || tokens[i+1].Type != TokenString {
+			errs.add(tok.Pos, errorAt(tok, "%s needs a quoted file name", tok.Value))
+			i = end - 1
+			continue
+		}
+		nameToken := tokens[i+1]
+		nameToken.Pos.File = file
+		args, end = arguments(tokens, i+2)
+		i = end - 1
+		path, err := a.find(nameToken.Value, file)
+		if err != nil {
+			errs.add(nameToken.Pos, errorAt(nameToken, "%s: %v", tok.Value, err))
+			continue
+		}
+
+		if tok.Value == ".incbin" {
+			data, err := readRange(path, args)
+			if err != nil {
+				errs.add(tok.Pos, errorAt(tok, ".incbin: %v", err))
+				continue
+			}
+			// The parser places the bytes like an .ascii string.
+			out = append(out, tok, Token{Type: TokenString, Value: string(data), Pos: nameToken.Pos})
+			continue
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			errs.add(nameToken.Pos, errorAt(nameToken, ".include: %v", err))
+			continue
+		}
+		cycle := false
+		for j, open := range stack {
+			if open == abs {
+				chain := append(append([]string{}, stack[j:]...), abs)
+				errs.add(nameToken.Pos, errorAt(nameToken, ".include cycle: %s", strings.Join(chain, " -> ")))
+				cycle = true
+				break
+			}
+		}
+		if cycle {
+			continue
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			errs.add(nameToken.Pos, errorAt(nameToken, ".include: %v", err))
+			continue
+		}
+		out = append(out, a.include(path, string(text), append(stack, abs), errs)...)
+	}
+	return out
+}
+
+// find resolves a file name from an .include or .incbin directive.
+func (a *Assembler) find(name string, from string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dirs := []string{"."}
+	if from != "" {
+		dirs[0] = filepath.Dir(from)
+	}
+	dirs = append(dirs, a.IncludePaths...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in %s", name, strings.Join(dirs, ", "))
+}
+
+// readRange reads a file for .incbin, honouring the optional skip and
+// length arguments.
+func readRange(path string, args []Token) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("expected at most a skip and a length")
+	}
+	bounds := []int{0, len(data)}
+	for j, arg := range args {
+		n, err := constant(rawText(arg))
+		if err != nil {
+			return nil, err
+		}
+		bounds[j] = n
+	}
+	skip, n := bounds[0], bounds[1]
+	if len(args) < 2 {
+		n = len(data) - skip
+	}
+	if skip < 0 || n < 0 || skip+n > len(data) {
+		return nil, fmt.Errorf("range %d+%d is outside the %d-byte file %s", skip, n, len(data), path)
+	}
+	return data[skip : skip+n], nil
+}
@@ -0,0 +1,329 @@
+package assembler
+
+import (
+	"bytes"
+	"code/g16/cpu"
+	. "code/g16/isa"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rr(opcode, mode, rx, ry uint16) uint16 {
+	return opcode<<cpu.OPCODE_OFFSET | mode<<cpu.FLAG_OFFSET | rx<<cpu.RX_OFFSET | ry<<cpu.RY_OFFSET
+}
+
+func rli(opcode, rl, i uint16) uint16 {
+	return opcode<<cpu.OPCODE_OFFSET | rl<<cpu.RL_OFFSET | i<<cpu.I_OFFSET
+}
+
+// text assembles source and returns the words of its .text segment.
+func text(t *testing.T, source string) []uint16 {
+	t.Helper()
+	program, err := Assemble(source)
+	if err != nil {
+		t.Fatalf("Assemble(%q): %v", source, err)
+	}
+	for _, segment := range program.Segments {
+		if segment.Name == SECTION_TEXT {
+			words := make([]uint16, len(segment.Bytes)/cpu.BYTES_PER_WORD)
+			for i := range words {
+				words[i] = binary.LittleEndian.Uint16(segment.Bytes[i*cpu.BYTES_PER_WORD:])
+			}
+			return words
+		}
+	}
+	t.Fatalf("Assemble(%q): no .text segment", source)
+	return nil
+}
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []uint16
+	}{
+		{"halt", "halt", []uint16{rr(HALT, 0, 0, 0)}},
+		{"inc", "inc $r1", []uint16{rr(INC, 0, 1, 0)}},
+		{"add", "add $r1, $r10", []uint16{rr(ADD, 0, 1, 10)}},
+		{"jump target", "jnz $r3, @r2", []uint16{rr(JNZ, 0, 3, 2)}},
+		{"register names", "push $pc\npush $sp\npop $rf", []uint16{
+			rr(PUSH, 0, cpu.RPC, 0), rr(PUSH, 0, cpu.RSP, 0), rr(POP, 0, cpu.RF, 0),
+		}},
+		{"mov DD", "mov $r1, $r2", []uint16{rr(MOV, DD, 1, 2)}},
+		{"mov DLI", "mov $r1, @r2", []uint16{rr(MOV, DLI, 1, 2)}},
+		{"mov DUI", "mov %r1, @r2", []uint16{rr(MOV, DUI, 1, 2)}},
+		{"mov DWI", "mov &r1, @r2", []uint16{rr(MOV, DWI, 1, 2)}},
+		{"mov II", "mov @r0, @r1", []uint16{rr(MOV, II, 0, 1)}},
+		{"mov IDL", "mov @r1, $r2", []uint16{rr(MOV, IDL, 1, 2)}},
+		{"mov IDU", "mov @r1, %r2", []uint16{rr(MOV, IDU, 1, 2)}},
+		{"mov IDW", "mov @r1, &r12", []uint16{rr(MOV, IDW, 1, 12)}},
+		{"mov #i", "mov $r2, #d13", []uint16{rli(MOVI, 2, 13)}},
+		{"mov #x", "mov $r2, #xFF", []uint16{rli(MOVI, 2, 0xFF)}},
+		{"mov negative", "mov $r1, #-1\nmov $r2, #-128", []uint16{rli(MOVI, 1, 0xFF), rli(MOVI, 2, 0x80)}},
+		{"mov ^i", "mov $r1, ^x12", []uint16{rli(MOVIU, 1, 0x12)}},
+		{"mov ^expr", "mov $r1, ^hi(0xAB00)", []uint16{rli(MOVIU, 1, 0xAB)}},
+		{"moviu", "moviu $r7, ^d3", []uint16{rli(MOVIU, 7, 3)}},
+		{"movio forward", "mov $r1, =end\nnop\nnop\nend:", []uint16{
+			rli(MOVIO, 1, 6), rr(NOP, 0, 0, 0), rr(NOP, 0, 0, 0),
+		}},
+		{"movio self", "here: movio $r1, =here", []uint16{rli(MOVIO, 1, 0)}},
+		{"shifted constant", ".equ BIG, 100000\n.word BIG & 0xFFFF, BIG >> 16", []uint16{0x86A0, 0x0001}},
+		{"data", ".word #d14, #xFFFF, =x\nx: .byte #d1, #d2\n.ascii \"ab\"\n.asciz \"c\"", []uint16{
+			14, 0xFFFF, cpu.PROGRAM_START + 6, 0x0201, 'b'<<8 | 'a', 'c',
+		}},
+		{"fill", ".byte #d1\n.align #d2\n.fill #d2, #d2, #x1234\n.space #d3, #xAA\n.align #d2", []uint16{
+			1, 0x1234, 0x1234, 0xAAAA, 0x00AA,
+		}},
+		{"addi", "addi $r3, #(2 * 3)", []uint16{rli(ADDI, 3, 6)}},
+		{"character", "mov $r1, #'A'", []uint16{rli(MOVI, 1, 'A')}},
+		{"constant", ".equ N, 3 + 4\nmov $r1, #N", []uint16{rli(MOVI, 1, 7)}},
+		{"set", ".set N, 1\nmov $r1, #N\n.set N, 2\nmov $r1, #N", []uint16{
+			rli(MOVI, 1, 1), rli(MOVI, 1, 2),
+		}},
+		{"expressions", ".word (3 + 4) * 2, lo(0x1234), hi(0x1234), -1", []uint16{14, 0x34, 0x12, 0xFFFF}},
+		{"operators", ".word 0x100 >> 4, 1 << 15, 0xF0 & 0x3C | 1, ~0, -(2 - 5)", []uint16{
+			0x10, 0x8000, 0x31, 0xFFFF, 3,
+		}},
+		{"local labels", "a: mov $r1, =.x\n.x: b: mov $r1, =.x\nnop\n.x:", []uint16{
+			rli(MOVIO, 1, 2), rli(MOVIO, 1, 4), rr(NOP, 0, 0, 0),
+		}},
+		{"numeric labels", "1: mov $r1, =1f\n1: mov $r2, =1f\nnop\n1:", []uint16{
+			rli(MOVIO, 1, 2), rli(MOVIO, 2, 4), rr(NOP, 0, 0, 0),
+		}},
+		{"numeric backward", "1: nop\n.word 1b, 2f\n2:", []uint16{
+			rr(NOP, 0, 0, 0), cpu.PROGRAM_START, cpu.PROGRAM_START + 6,
+		}},
+		{"macro", ".macro li r, v=#d1\nmovi \\r, \\v\n.endm\nli $r1\nli $r2, #'x'", []uint16{
+			rli(MOVI, 1, 1), rli(MOVI, 2, 'x'),
+		}},
+		{"rept", ".rept 2\ninc $r1\n.endr", []uint16{rr(INC, 0, 1, 0), rr(INC, 0, 1, 0)}},
+		{"irp", ".irp r, 1, 2\ninc $r\\r\n.endr", []uint16{rr(INC, 0, 1, 0), rr(INC, 0, 2, 0)}},
+		{"org", ".text #xF000\nnop\n.org #xF006\nhalt", []uint16{rr(NOP, 0, 0, 0), 0, 0, rr(HALT, 0, 0, 0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := text(t, tt.source)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %04X, want %04X", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %04X, want %04X", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSections(t *testing.T) {
+	program, err := Assemble("halt\n.data\nx:\n#'ab'")
+	if err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	if len(program.Segments) != 2 {
+		t.Fatalf("got %d segments, want .text and .data", len(program.Segments))
+	}
+	data := program.Segments[1]
+	if data.Name != SECTION_DATA || data.Address != cpu.PROGRAM_START+2 {
+		t.Errorf("got %s at %04X, want .data at %04X", data.Name, data.Address, cpu.PROGRAM_START+2)
+	}
+	if got := binary.LittleEndian.Uint16(data.Bytes); got != 'a' {
+		t.Errorf("first .data word = %04X, want %04X", got, 'a')
+	}
+}
+
+// errorList assembles source and returns the diagnostics it fails with.
+func errorList(t *testing.T, source string) ErrorList {
+	t.Helper()
+	_, err := Assemble(source)
+	var errs ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("Assemble(%q) = %v, want an ErrorList", source, err)
+	}
+	return errs
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		message string
+		line    int
+		column  int
+	}{
+		{"operand count", "inc $r1 $r2 #d5", "inc: expected 1 operand, got 3", 1, 1},
+		{"missing operand", "mov $banana", "mov: expected 2 operands, got 1", 1, 1},
+		{"invalid register", "mov $banana, $r1", `invalid register "banana"`, 1, 5},
+		{"register range", "inc $r16", `register "r16" out of range r0-r15`, 1, 5},
+		{"low register range", "movi $r8, #d1", `register "r8" out of range r0-r7`, 1, 6},
+		{"named low register", "mov $sp, #d1", `register "sp" (r14) out of range r0-r7`, 1, 5},
+		{"not an operand", "mov $r1, label", `expected an operand, got IDENTIFIER "label"`, 1, 10},
+		{"mov modes", "mov &r1, &r2", "mov: cannot move an &register to an &register", 1, 5},
+		{"upper immediate", "movi $r1, ^d1", "movi: a ^immediate is only valid with mov and moviu", 1, 11},
+		{"mov immediate", "mov @r1, #d1", "mov: expected a $register, got an @register", 1, 5},
+		{"immediate source", "addi $r1, $r2", "addi: expected an immediate, got a $register", 1, 11},
+		{"immediate range", "nop\nmov $r1, #d256", "mov: immediate 256 does not fit in 8 bits", 2, 10},
+		{"negative immediate range", "mov $r1, #-129", "mov: immediate -129 does not fit in 8 bits", 1, 10},
+		{"movio backwards", "back: nop\nmov $r1, =back", "mov: target is 2 bytes behind the instruction; MOVIO only reaches 0-255 bytes forward", 2, 10},
+		{"movio numeric backwards", "1: nop\nmov $r1, =1b", "mov: target is 2 bytes behind the instruction", 2, 10},
+		{"movio too far", "mov $r1, =far\n.space 300\nfar:", "mov: target is 302 bytes ahead of the instruction", 1, 10},
+		{"org without base", ".data\n.org #xF004", ".org in .data needs a base address", 2, 1},
+		{"org backwards", ".text #xF000\nnop\nnop\n.org #xF002", ".org F002 would move .text backwards from F004", 4, 1},
+		{"overlap", ".text #xF000\nnop\nnop\n.data #xF002\nx:\n#'a'", "section .text (F000-F003) overlaps .data (F002-F003)", 6, 1},
+		{"top of memory", ".text #xFFFE\nnop\nnop", "section .text ends past the top of memory at 0x10002", 3, 1},
+		{"initialized bss", ".bss\n.word #d1", "initialized data in .bss", 2, 1},
+		{"odd address", ".byte #d1\nnop", "instruction at odd address F001", 2, 1},
+		{"byte range", ".byte #d256", "value 256 does not fit in 8 bits", 1, 7},
+		{"fill size", ".fill #d1, #d3, #d0", ".fill needs a non-negative count and a size of 1 or 2", 1, 1},
+		{"unknown directive", ".bogus", "unknown directive .bogus", 1, 1},
+		{"duplicate constant", ".equ N, 1\n.equ N, 2", ".equ N is already defined", 2, 6},
+		{"undefined symbol", "mov $r1, #missing", "undefined symbol: missing", 1, 10},
+		{"division by zero", ".word 1 / 0", "division by zero", 1, 7},
+		{"negative shift", ".word 1 << -1", "negative shift count -1", 1, 7},
+		{"negative shift operand", "mov $r1, #(1 >> -2)", "negative shift count -2", 1, 10},
+		{"large shift", ".word 1 << 70", "shift count 70 is not less than 63", 1, 7},
+		{"shifted out of range", ".word 1 << 16", "value 65536 does not fit in 16 bits", 1, 7},
+		{"duplicate label", "a: nop\na: nop", "label a is already defined", 2, 1},
+		{"local label without scope", ".x: nop", "local label .x has no global label before it", 1, 1},
+		{"nested macros", ".macro m\nm\n.endm\nm", "macros nested more than 64 deep", 4, 1},
+		{"unterminated macro", ".macro m\nnop", ".macro without a matching .endm", 1, 1},
+		{"macro arguments", ".macro m a\n.endm\nm 1, 2", "macro m takes 1 arguments, got 2", 3, 1},
+		{"rept count", ".rept 1000000 * 1000000\nnop\n.endr", ".rept count 1000000000000 is more than", 1, 7},
+		{"expansion size", ".rept 1 << 15\n.rept 1 << 15\nnop\n.endr\n.endr", "produce more than", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := errorList(t, tt.source)
+			d := errs[0]
+			if !strings.Contains(d.Message, tt.message) {
+				t.Errorf("error %q, want it to contain %q", d.Message, tt.message)
+			}
+			if d.Pos.Line != tt.line || d.Pos.Column != tt.column {
+				t.Errorf("error at %d:%d, want %d:%d", d.Pos.Line, d.Pos.Column, tt.line, tt.column)
+			}
+		})
+	}
+}
+
+func TestMultipleErrors(t *testing.T) {
+	errs := errorList(t, "a: nop\na: nop\nmov $r1, #(1 +)\n.word missing\nhalt $r1")
+	want := []int{2, 3, 5, 4} // Operands are resolved after the first pass
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, d := range errs {
+		if d.Pos.Line != want[i] {
+			t.Errorf("error %d on line %d, want %d: %v", i, d.Pos.Line, want[i], d)
+		}
+	}
+}
+
+func TestExpansionNotes(t *testing.T) {
+	errs := errorList(t, ".macro li r, v\nmovi \\r, \\v\n.endm\nli $r1, #d500")
+	d := errs[0]
+	if d.Pos.Line != 2 {
+		t.Errorf("error on line %d, want the macro body's line 2", d.Pos.Line)
+	}
+	if len(d.Notes) != 1 || !strings.Contains(d.Notes[0], "macro li defined at 1:1, expanded at 4:1") {
+		t.Errorf("notes %q, want the definition and call site", d.Notes)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	var b bytes.Buffer
+	errorList(t, "\tnop\n\tmov $r1, #d256").Print(&b)
+	want := "2:11: error: mov: immediate 256 does not fit in 8 bits\n" +
+		"\tmov $r1, #d256\n" +
+		"\t         ^\n"
+	if b.String() != want {
+		t.Errorf("Print wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := errorList(t, "a: nop\na: nop").WriteJSON(&b); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	for _, want := range []string{`"line": 2`, `"column": 1`, `"severity": "error"`, `"first defined at 1:1"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("WriteJSON wrote %s, want it to contain %s", b.String(), want)
+		}
+	}
+}
+
+// writeFiles creates files in a temporary directory and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.s":   ".include \"inc.s\"\n.incbin \"data.bin\", 1, 2\n",
+		"inc.s":    "inc $r1\n",
+		"data.bin": "\x01\x02\x03\x04",
+	})
+	program, err := (&Assembler{}).AssembleFile(filepath.Join(dir, "main.s"))
+	if err != nil {
+		t.Fatalf("AssembleFile: %v", err)
+	}
+	want := []byte{0x10, byte(INC << 3), 0x02, 0x03}
+	if got := program.Segments[0].Bytes; !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+}
+
+func TestIncludePath(t *testing.T) {
+	lib := writeFiles(t, map[string]string{"lib.s": "halt\n"})
+	dir := writeFiles(t, map[string]string{"main.s": ".include \"lib.s\"\n"})
+	a := &Assembler{IncludePaths: []string{lib}}
+	if _, err := a.AssembleFile(filepath.Join(dir, "main.s")); err != nil {
+		t.Fatalf("AssembleFile: %v", err)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.s":       ".include \"b.s\"\n",
+		"b.s":       "nop\n.include \"a.s\"\n",
+		"missing.s": ".include \"nowhere.s\"\n",
+		"bad.s":     "nop\n\tinc $r99\n",
+		"outer.s":   ".include \"bad.s\"\n",
+	})
+	tests := []struct {
+		file    string
+		message string
+		pos     string
+	}{
+		{"a.s", ".include cycle", "b.s:2:10"},
+		{"missing.s", `"nowhere.s" not found`, "missing.s:1:10"},
+		{"outer.s", `register "r99" out of range`, "bad.s:2:6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, err := (&Assembler{}).AssembleFile(filepath.Join(dir, tt.file))
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("AssembleFile = %v, want an ErrorList", err)
+			}
+			d := errs[0]
+			if !strings.Contains(d.Message, tt.message) {
+				t.Errorf("error %q, want it to contain %q", d.Message, tt.message)
+			}
+			if !strings.HasSuffix(d.Pos.String(), tt.pos) {
+				t.Errorf("error at %s, want %s", d.Pos, tt.pos)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseData handles the data directives:
+//
+//	.byte v, ...            one byte per value
+//	.word v, ...            one little-endian word per value
+//	.ascii "s"              the characters of s, one byte each
+//	.asciz "s"              as .ascii with a terminating zero byte
+//	.incbin "file"          the file's bytes, read before parsing
+//	.fill count, size, v    count copies of the size-byte value v
+//	.space n [, v]          n bytes of v, zero by default
+//	.align n [, v]          pad with v until the address is a multiple of n
+//
+// Values are expressions; .byte and .word values may refer to labels
+// defined later, the others must be known in the first pass. In .bss only zero
+// padding from .space, .fill and .align is allowed; it reserves space.
+func (p *Parser) parseData(directive Token) error {
+	switch directive.Value {
+	case ".byte", ".word":
+		width := 1
+		if directive.Value == ".word" {
+			width = 2
+		}
+		var values []Operand
+		for p.pos < len(p.tokens) && isExpression(p.tokens[p.pos]) {
+			tok := p.tokens[p.pos]
+			expr, err := p.expression()
+			if err != nil {
+				return err
+			}
+			values = append(values, Operand{Type: OperandImmExpr, Value: tok.Value, expr: expr, source: tok})
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("%s needs at least one value", directive.Value)
+		}
+		if err := p.requireInitialized(); err != nil {
+			return err
+		}
+		item := p.newDataItem()
+		item.Values = values
+		item.Width = width
+		p.emit(item, len(values)*width)
+	case ".ascii", ".asciz", ".incbin":
+		text, ok := "", false
+		if p.pos < len(p.tokens) {
+			text, ok = stringValue(p.tokens[p.pos])
+		}
+		if !ok {
+			return p.errorAt(p.pos, "%s needs a string", directive.Value)
+		}
+		bytes := []byte(text)
+		p.pos++
+		if directive.Value == ".asciz" {
+			bytes = append(bytes, 0)
+		}
+		if err := p.requireInitialized(); err != nil {
+			return err
+		}
+		item := p.newDataItem()
+		item.Bytes = bytes
+		p.emit(item, len(bytes))
+	case ".fill":
+		count, err := p.number()
+		if err != nil {
+			return err
+		}
+		size, err := p.number()
+		if err != nil {
+			return err
+		}
+		value, err := p.number()
+		if err != nil {
+			return err
+		}
+		if count < 0 || (size != 1 && size != 2) {
+			return fmt.Errorf(".fill needs a non-negative count and a size of 1 or 2")
+		}
+		unit, err := littleEndian(value, size)
+		if err != nil {
+			return fmt.Errorf(".fill: %w", err)
+		}
+		return p.pad(count*size, unit)
+	case ".space":
+		n, err := p.number()
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf(".space needs a non-negative size")
+		}
+		unit, err := p.padValue()
+		if err != nil {
+			return err
+		}
+		return p.pad(n, unit)
+	case ".align":
+		n, err := p.number()
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf(".align needs a positive boundary")
+		}
+		unit, err := p.padValue()
+		if err != nil {
+			return err
+		}
+		p.section.Align = max(p.section.Align, n)
+		address := p.section.Base + p.addrCounter
+		return p.pad((n-address%n)%n, unit)
+	}
+	return nil
+}
+
+// padValue consumes the optional fill byte of .space and .align.
+func (p *Parser) padValue() ([]byte, error) {
+	if p.pos >= len(p.tokens) || !isExpression(p.tokens[p.pos]) {
+		return []byte{0}, nil
+	}
+	value, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	return littleEndian(value, 1)
+}
+
+// pad places n bytes repeating unit. Zero padding in .bss only reserves
+// space.
+func (p *Parser) pad(n int, unit []byte) error {
+	if n == 0 {
+		return nil
+	}
+	zero := true
+	for _, b := range unit {
+		zero = zero && b == 0
+	}
+	if p.section.Name == SECTION_BSS && zero {
+		p.advance(n)
+		return nil
+	}
+	if err := p.requireInitialized(); err != nil {
+		return err
+	}
+	item := p.newDataItem()
+	item.Bytes = make([]byte, n)
+	for i := range item.Bytes {
+		item.Bytes[i] = unit[i%len(unit)]
+	}
+	p.emit(item, n)
+	return nil
+}
+
+// requireInitialized rejects code and non-zero data in .bss.
+func (p *Parser) requireInitialized() error {
+	if p.section.Name == SECTION_BSS {
+		return fmt.Errorf("initialized data in %s", SECTION_BSS)
+	}
+	return nil
+}
+
+// newDataItem starts a data item at the current location.
+func (p *Parser) newDataItem() DataItem {
+	return DataItem{
+		Label:   p.lastLabel,
+		Address: p.addrCounter,
+		Section: p.section.Name,
+	}
+}
+
+// emit records a data item and moves past its size in bytes.
+func (p *Parser) emit(item DataItem, size int) {
+	p.dataItems = append(p.dataItems, item)
+	p.advance(size)
+}
+
+// littleEndian encodes value in size bytes, accepting signed or unsigned
+// ranges.
+func littleEndian(value int, size int) ([]byte, error) {
+	bits := size * 8
+	if value < -(1<<(bits-1)) || value >= 1<<bits {
+		return nil, fmt.Errorf("value %d does not fit in %d bits", value, bits)
+	}
+	bytes := make([]byte, size)
+	for i := range bytes {
+		bytes[i] = byte(value >> (8 * i))
+	}
+	return bytes, nil
+}
+
+// stringValue returns the text of a string token, or of a quoted string
+// passed through a macro argument.
+func stringValue(tok Token) (string, bool) {
+	switch tok.Type {
+	case TokenString, TokenImmAscii:
+		return tok.Value, true
+	case TokenExpr:
+		value := tok.Value
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			return unescape(value[1 : len(value)-1]), true
+		}
+		if len(value) >= 3 && strings.HasPrefix(value, "#'") && value[len(value)-1] == '\'' {
+			return unescape(value[2 : len(value)-1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,146 @@
+package assembler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Diagnostic is an error found while assembling.
+type Diagnostic struct {
+	Pos     Pos
+	Message string
+	Notes   []string // Context such as a macro expansion or an earlier definition
+	Source  string   // The source line Pos points into, when known
+}
+
+func (d *Diagnostic) Error() string {
+	s := d.Message
+	if where := d.Pos.String(); where != "" {
+		s = where + ": " + s
+	}
+	for _, note := range d.Notes {
+		s += " (" + note + ")"
+	}
+	return s
+}
+
+// ErrorList holds every diagnostic from one assembly. Assemble returns it
+// as the error when anything went wrong.
+type ErrorList []*Diagnostic
+
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", list[0], len(list)-1)
+}
+
+// add records err, placing it at pos unless it already carries a position.
+func (list *ErrorList) add(pos Pos, err error) {
+	var more ErrorList
+	var d *Diagnostic
+	switch {
+	case errors.As(err, &more):
+		*list = append(*list, more...)
+	case errors.As(err, &d):
+		*list = append(*list, d)
+	default:
+		*list = append(*list, &Diagnostic{Pos: pos, Message: err.Error()})
+	}
+}
+
+// err returns the list as an error, or nil when it is empty.
+func (list ErrorList) err() error {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// errorAt builds a diagnostic at tok, noting the macro expansions it came
+// from.
+func errorAt(tok Token, format string, args ...any) *Diagnostic {
+	d := &Diagnostic{Pos: tok.Pos, Message: fmt.Sprintf(format, args...)}
+	for e := tok.expansion; e != nil; e = e.parent {
+		d.Notes = append(d.Notes, e.String())
+	}
+	return d
+}
+
+// Print writes the diagnostics compiler style, with the source line and a
+// caret under the offending column:
+//
+//	prog.s:3:11: error: register "r99" out of range r0-r15
+//	        mov $r99, #d1
+//	            ^
+func (list ErrorList) Print(w io.Writer) {
+	for _, d := range list {
+		where := d.Pos.String()
+		if where != "" {
+			where += ": "
+		}
+		fmt.Fprintf(w, "%serror: %s\n", where, d.Message)
+		if d.Source != "" && d.Pos.Column > 0 {
+			fmt.Fprintf(w, "%s\n", d.Source)
+			// Keep tabs so the caret lines up with the source line.
+			indent := []byte(d.Source[:min(d.Pos.Column-1, len(d.Source))])
+			for i, c := range indent {
+				if c != '\t' {
+					indent[i] = ' '
+				}
+			}
+			fmt.Fprintf(w, "%s^\n", indent)
+		}
+		for _, note := range d.Notes {
+			fmt.Fprintf(w, "\tnote: %s\n", note)
+		}
+	}
+}
+
+// jsonDiagnostic is the editor-facing form of a Diagnostic.
+type jsonDiagnostic struct {
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	Notes    []string `json:"notes,omitempty"`
+}
+
+// WriteJSON writes the diagnostics as a JSON array for editors.
+func (list ErrorList) WriteJSON(w io.Writer) error {
+	out := make([]jsonDiagnostic, len(list))
+	for i, d := range list {
+		out[i] = jsonDiagnostic{
+			File:     d.Pos.File,
+			Line:     d.Pos.Line,
+			Column:   d.Pos.Column,
+			Severity: "error",
+			Message:  d.Message,
+			Notes:    d.Notes,
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// attachSource fills in each diagnostic's source line from the files read.
+func (list ErrorList) attachSource(sources map[string]string) {
+	for _, d := range list {
+		source, ok := sources[d.Pos.File]
+		if !ok || d.Pos.Line == 0 {
+			continue
+		}
+		lines := strings.Split(source, "\n")
+		if d.Pos.Line <= len(lines) {
+			d.Source = strings.TrimRight(lines[d.Pos.Line-1], "\r")
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package assembler
+
+import (
+	"code/g16/cpu"
+	. "code/g16/isa"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Program is an assembled image ready to be loaded into memory.
+type Program struct {
+	Segments []Segment
+}
+
+// Segment is the initialized contents of one section. Sections that hold
+// no initialized bytes, such as .bss, have no segment because RAM starts
+// zeroed.
+type Segment struct {
+	Name    string
+	Address int    // Address Bytes[0] loads at
+	Bytes   []byte // Little-endian machine code and data
+}
+
+// Encode turns parsed instructions and data into one segment per
+// non-empty section, using the field layout in cpu/const.go. Every
+// operand that does not fit is reported, in an ErrorList.
+func Encode(sections []Section, instructions []Instruction, data []DataItem) (*Program, error) {
+	program := &Program{}
+	segments := make(map[string]*Segment)
+	for _, section := range sections {
+		if section.Size == 0 || section.Name == SECTION_BSS {
+			continue
+		}
+		program.Segments = append(program.Segments, Segment{
+			Name:    section.Name,
+			Address: section.Base,
+			Bytes:   make([]byte, section.Size),
+		})
+	}
+	for i := range program.Segments {
+		segments[program.Segments[i].Name] = &program.Segments[i]
+	}
+
+	var errs ErrorList
+	for _, inst := range instructions {
+		word, err := encodeInstruction(inst)
+		if d, ok := err.(*Diagnostic); ok {
+			d.Message = inst.Opcode + ": " + d.Message
+			errs = append(errs, d)
+			continue
+		}
+		if err != nil {
+			at := Token{Pos: inst.Pos, expansion: inst.expansion}
+			errs = append(errs, errorAt(at, "%s: %v", inst.Opcode, err))
+			continue
+		}
+		segments[inst.Section].put(inst.Address, word)
+	}
+	for _, item := range data {
+		segment := segments[item.Section]
+		for i := 0; i < len(item.Data); i++ {
+			segment.put(item.Address+i*cpu.BYTES_PER_WORD, uint16(item.Data[i]))
+		}
+		segment.write(item.Address, item.Bytes)
+		for i, op := range item.Values {
+			value, err := operandValue(op)
+			if err == nil {
+				var bytes []byte
+				bytes, err = littleEndian(int(value), item.Width)
+				segment.write(item.Address+i*item.Width, bytes)
+			}
+			if err != nil {
+				errs = append(errs, errorAt(op.source, "%v", err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return program, nil
+}
+
+// put stores a little-endian word at an absolute address.
+func (segment *Segment) put(address int, word uint16) {
+	binary.LittleEndian.PutUint16(segment.Bytes[address-segment.Address:], word)
+}
+
+// write copies bytes to an absolute address.
+func (segment *Segment) write(address int, bytes []byte) {
+	copy(segment.Bytes[address-segment.Address:], bytes)
+}
+
+// Operand shapes each opcode accepts.
+type format int
+
+const (
+	formatNone format = iota // halt
+	formatRX                 // inc $rx
+	formatRXRY               // jnz $rx, @ry
+	formatRLI                // addi $rl, #i
+	formatMOV                // mov picks its own opcode from the operand modes
+)
+
+type opcodeInfo struct {
+	opcode uint16
+	format format
+}
+
+var opcodes = map[string]opcodeInfo{
+	"halt":  {HALT, formatNone},
+	"mov":   {MOV, formatMOV},
+	"movi":  {MOVI, formatRLI},
+	"moviu": {MOVIU, formatRLI},
+	"movio": {MOVIO, formatRLI},
+	"inc":   {INC, formatRX},
+	"dec":   {DEC, formatRX},
+	"add":   {ADD, formatRXRY},
+	"addi":  {ADDI, formatRLI},
+	"sub":   {SUB, formatRXRY},
+	"subi":  {SUBI, formatRLI},
+	"mul":   {MUL, formatRXRY},
+	"div":   {DIV, formatRXRY},
+	"and":   {AND, formatRXRY},
+	"or":    {OR, formatRXRY},
+	"xor":   {XOR, formatRXRY},
+	"not":   {NOT, formatRX},
+	"shl":   {SHL, formatRXRY},
+	"shr":   {SHR, formatRXRY},
+	"jmp":   {JMP, formatRX},
+	"je":    {JE, formatRXRY},
+	"jz":    {JZ, formatRXRY},
+	"jnz":   {JNZ, formatRXRY},
+	"jc":    {JC, formatRX},
+	"jnc":   {JNC, formatRX},
+	"call":  {CALL, formatRX},
+	"ret":   {RET, formatNone},
+	"push":  {PUSH, formatRX},
+	"pop":   {POP, formatRX},
+	"nop":   {NOP, formatNone},
+	"reti":  {RETI, formatNone},
+}
+
+// encodeInstruction packs one instruction into its 16-bit machine word.
+func encodeInstruction(inst Instruction) (uint16, error) {
+	info, ok := opcodes[inst.Opcode]
+	if !ok {
+		return 0, fmt.Errorf("unknown opcode")
+	}
+	ops := inst.Operands
+	switch info.format {
+	case formatNone:
+		if len(ops) != 0 {
+			return 0, fmt.Errorf("expected no operands, got %d", len(ops))
+		}
+		return encodeRR(info.opcode, 0, 0, 0), nil
+	case formatRX:
+		if len(ops) != 1 {
+			return 0, fmt.Errorf("expected 1 operand, got %d", len(ops))
+		}
+		rx, err := register(ops[0], R_MAX)
+		if err != nil {
+			return 0, errorAt(ops[0].source, "%v", err)
+		}
+		return encodeRR(info.opcode, 0, rx, 0), nil
+	case formatRXRY:
+		if len(ops) != 2 {
+			return 0, fmt.Errorf("expected 2 operands, got %d", len(ops))
+		}
+		rx, err := register(ops[0], R_MAX)
+		if err != nil {
+			return 0, errorAt(ops[0].source, "%v", err)
+		}
+		ry, err := register(ops[1], R_MAX)
+		if err != nil {
+			return 0, errorAt(ops[1].source, "%v", err)
+		}
+		return encodeRR(info.opcode, 0, rx, ry), nil
+	case formatRLI:
+		if len(ops) != 2 {
+			return 0, fmt.Errorf("expected 2 operands, got %d", len(ops))
+		}
+		return encodeRLI(info.opcode, ops[0], ops[1], inst.Address)
+	case formatMOV:
+		return encodeMOV(ops, inst.Address)
+	}
+	return 0, fmt.Errorf("unsupported operand format")
+}
+
+// encodeMOV chooses between the register-to-register MOV modes and the
+// MOVI/MOVIU/MOVIO immediate forms based on the operand prefixes:
+//
+//	$rx  register   @rx  memory at register   %rx  upper byte   &rx  word
+//	#i   lower byte (RLI)   ^i  upper byte (RUI)   =i  address (RLA)
+func encodeMOV(ops []Operand, address int) (uint16, error) {
+	if len(ops) != 2 {
+		return 0, fmt.Errorf("expected 2 operands, got %d", len(ops))
+	}
+	dst, src := ops[0], ops[1]
+	switch src.Type {
+	case OperandImmDec, OperandImmHex, OperandImmExpr:
+		return encodeRLI(MOVI, dst, src, address)
+	case OperandImmUpper:
+		return encodeRLI(MOVIU, dst, src, address)
+	case OperandLabelImm:
+		return encodeRLI(MOVIO, dst, src, address)
+	}
+
+	mode, ok := movModes[[2]OperandType{dst.Type, src.Type}]
+	if !ok {
+		return 0, fmt.Errorf("unsupported operand modes")
+	}
+	rx, err := register(dst, R_MAX)
+	if err != nil {
+		return 0, errorAt(dst.source, "%v", err)
+	}
+	ry, err := register(src, R_MAX)
+	if err != nil {
+		return 0, errorAt(src.source, "%v", err)
+	}
+	return encodeRR(MOV, mode, rx, ry), nil
+}
+
+// movModes maps the destination and source prefixes of a register MOV to
+// its memory mode.
+var movModes = map[[2]OperandType]uint16{
+	{OperandRegDirect, OperandRegDirect}:     DD,
+	{OperandRegDirect, OperandRegIndirect}:   DLI,
+	{OperandRegUpper, OperandRegIndirect}:    DUI,
+	{OperandRegWord, OperandRegIndirect}:     DWI,
+	{OperandRegIndirect, OperandRegIndirect}: II,
+	{OperandRegIndirect, OperandRegDirect}:   IDL,
+	{OperandRegIndirect, OperandRegUpper}:    IDU,
+	{OperandRegIndirect, OperandRegWord}:     IDW,
+}
+
+// encodeRLI packs a low register and an 8-bit immediate. Label immediates
+// become an offset from the instruction's own address, which is what
+// MOVIO adds back at run time.
+func encodeRLI(opcode uint16, dst Operand, src Operand, address int) (uint16, error) {
+	rl, err := register(dst, RL_MAX)
+	if err != nil {
+		return 0, errorAt(dst.source, "%v", err)
+	}
+	value, err := operandValue(src)
+	if err != nil {
+		return 0, errorAt(src.source, "%v", err)
+	}
+	if src.Type == OperandLabelImm && opcode == MOVIO {
+		// The offset is unsigned, so MOVIO can only point forwards.
+		value -= int64(address)
+		switch {
+		case value < 0:
+			return 0, errorAt(src.source, "target is %d bytes behind the instruction; MOVIO only reaches 0-%d bytes forward", -value, I_MAX)
+		case value > I_MAX:
+			return 0, errorAt(src.source, "target is %d bytes ahead of the instruction; MOVIO only reaches 0-%d bytes forward", value, I_MAX)
+		}
+	}
+	// Like data, the immediate may be written signed or unsigned.
+	if value < I_MIN || value > I_MAX {
+		return 0, errorAt(src.source, "immediate %d does not fit in %d bits", value, cpu.I_WIDTH)
+	}
+	return opcode<<cpu.OPCODE_OFFSET | uint16(rl)<<cpu.RL_OFFSET | uint16(value)&I_MAX<<cpu.I_OFFSET, nil
+}
+
+// operandValue parses a numeric or resolved label operand.
+func operandValue(op Operand) (int64, error) {
+	base := 10
+	switch op.Type {
+	case OperandImmDec, OperandLabelImm, OperandImmExpr, OperandImmUpper:
+	case OperandImmHex:
+		base = 16
+	default:
+		return 0, fmt.Errorf("expected an immediate operand")
+	}
+	value, err := strconv.ParseInt(op.Value, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid immediate %q", op.Value)
+	}
+	return value, nil
+}
+
+func encodeRR(opcode uint16, mode uint16, rx uint16, ry uint16) uint16 {
+	return opcode<<cpu.OPCODE_OFFSET | mode<<cpu.FLAG_OFFSET | rx<<cpu.RX_OFFSET | ry<<cpu.RY_OFFSET
+}
+
+// Largest register numbers each field can hold, and the immediate range.
+const (
+	R_MAX  = 1<<cpu.R_WIDTH - 1
+	RL_MAX = 1<<cpu.RL_WIDTH - 1
+	I_MAX  = 1<<cpu.I_WIDTH - 1
+	I_MIN  = -(1 << (cpu.I_WIDTH - 1)) // Negative immediates are stored in two's complement
+)
+
+// Symbolic names for the special registers.
+var registerNames = map[string]uint16{
+	"pc": cpu.RPC,
+	"sp": cpu.RSP,
+	"rf": cpu.RF,
+}
+
+// register parses an "rN" or named register operand and checks it fits
+// the field.
+func register(op Operand, max uint16) (uint16, error) {
+	switch op.Type {
+	case OperandRegDirect, OperandRegIndirect, OperandRegUpper, OperandRegWord:
+	default:
+		return 0, fmt.Errorf("expected a register, got %q", op.Value)
+	}
+	if n, ok := registerNames[op.Value]; ok {
+		if n > max {
+			return 0, fmt.Errorf("register %q (r%d) out of range r0-r%d", op.Value, n, max)
+		}
+		return n, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(op.Value, "r"), 10, 16)
+	if err != nil || !strings.HasPrefix(op.Value, "r") {
+		return 0, fmt.Errorf("invalid register %q", op.Value)
+	}
+	if n > uint64(max) {
+		return 0, fmt.Errorf("register %q out of range r0-r%d", op.Value, max)
+	}
+	return uint16(n), nil
+}
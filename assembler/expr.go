@@ -0,0 +1,382 @@
+package assembler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expression is a parsed operand expression. Names that are already
+// defined are bound when the expression is parsed, so a later .set does
+// not change what an earlier line saw. Names defined further down are
+// looked up by name in the second pass, which is how forward references
+// work.
+type expression struct {
+	kind        exprKind
+	op          string // Operator or function name
+	value       int    // exprNumber
+	name        string // exprSymbol, as written
+	key         string // exprSymbol, qualified for the symbol table
+	sym         *symbol
+	left, right *expression
+}
+
+type exprKind int
+
+const (
+	exprNumber exprKind = iota
+	exprSymbol
+	exprUnary
+	exprBinary
+	exprCall
+)
+
+// MAX_SHIFT bounds shift counts so that results stay meaningful in the
+// 64-bit arithmetic expressions use; the directive or instruction that
+// takes the value checks that it fits.
+const MAX_SHIFT = 63
+
+// Binary operators from loosest to tightest binding.
+var precedence = [][]string{
+	{"|"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+// exprParser reads an expression from source text:
+//
+//	13  0x1F  0b1010  'A'  #d13  #x1F  label  .  (a + b) * 2  lo(x)  hi(x)
+type exprParser struct {
+	text   string
+	pos    int
+	parser *Parser
+}
+
+// parseExpression parses text, binding symbols against the parser's
+// current state. "." is the current location.
+func (p *Parser) parseExpression(text string) (*expression, error) {
+	ep := &exprParser{text: text, parser: p}
+	e, err := ep.binary(0)
+	if err != nil {
+		return nil, fmt.Errorf("in expression %q: %w", text, err)
+	}
+	ep.skipSpace()
+	if ep.pos < len(ep.text) {
+		return nil, fmt.Errorf("in expression %q: unexpected %q", text, ep.text[ep.pos:])
+	}
+	return e, nil
+}
+
+func (ep *exprParser) skipSpace() {
+	for ep.pos < len(ep.text) && (ep.text[ep.pos] == ' ' || ep.text[ep.pos] == '\t') {
+		ep.pos++
+	}
+}
+
+func (ep *exprParser) binary(level int) (*expression, error) {
+	if level == len(precedence) {
+		return ep.unary()
+	}
+	left, err := ep.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ep.skipSpace()
+		op := ""
+		for _, candidate := range precedence[level] {
+			if strings.HasPrefix(ep.text[ep.pos:], candidate) {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		ep.pos += len(op)
+		right, err := ep.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &expression{kind: exprBinary, op: op, left: left, right: right}
+	}
+}
+
+func (ep *exprParser) unary() (*expression, error) {
+	ep.skipSpace()
+	if ep.pos < len(ep.text) && (ep.text[ep.pos] == '-' || ep.text[ep.pos] == '+' || ep.text[ep.pos] == '~') {
+		op := ep.text[ep.pos : ep.pos+1]
+		ep.pos++
+		operand, err := ep.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &expression{kind: exprUnary, op: op, left: operand}, nil
+	}
+	return ep.primary()
+}
+
+func (ep *exprParser) primary() (*expression, error) {
+	ep.skipSpace()
+	if ep.pos == len(ep.text) {
+		return nil, fmt.Errorf("missing operand")
+	}
+	c := ep.text[ep.pos]
+	switch {
+	case c == '(':
+		ep.pos++
+		e, err := ep.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := ep.expect(')'); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case c == '\'':
+		return ep.char()
+	case c == '#':
+		return ep.prefixedNumber()
+	case isDigit(c):
+		if name, ok := ep.anonymousReference(); ok {
+			return ep.parser.bindSymbol(name), nil
+		}
+		return ep.number()
+	case isNameStart(c):
+		start := ep.pos
+		for ep.pos < len(ep.text) && isNameChar(ep.text[ep.pos]) {
+			ep.pos++
+		}
+		name := ep.text[start:ep.pos]
+		ep.skipSpace()
+		if ep.pos < len(ep.text) && ep.text[ep.pos] == '(' {
+			return ep.call(name)
+		}
+		return ep.parser.bindSymbol(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", ep.text[ep.pos:])
+}
+
+func (ep *exprParser) expect(c byte) error {
+	ep.skipSpace()
+	if ep.pos == len(ep.text) || ep.text[ep.pos] != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	ep.pos++
+	return nil
+}
+
+// call parses the byte selectors lo(x) and hi(x).
+func (ep *exprParser) call(name string) (*expression, error) {
+	if name != "lo" && name != "hi" {
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+	ep.pos++ // skip '('
+	arg, err := ep.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := ep.expect(')'); err != nil {
+		return nil, err
+	}
+	return &expression{kind: exprCall, op: name, left: arg}, nil
+}
+
+// char parses a quoted character literal such as 'A' or '\n'.
+func (ep *exprParser) char() (*expression, error) {
+	end := ep.pos + 1
+	for end < len(ep.text) && ep.text[end] != '\'' {
+		if ep.text[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(ep.text) {
+		return nil, fmt.Errorf("unterminated character literal")
+	}
+	value := unescape(ep.text[ep.pos+1 : end])
+	if len(value) != 1 {
+		return nil, fmt.Errorf("character literal %s must be one character", ep.text[ep.pos:end+1])
+	}
+	ep.pos = end + 1
+	return &expression{kind: exprNumber, value: int(value[0])}, nil
+}
+
+// anonymousReference reads a numeric label reference such as 1f or 2b.
+func (ep *exprParser) anonymousReference() (string, bool) {
+	end := ep.pos
+	for end < len(ep.text) && isNameChar(ep.text[end]) {
+		end++
+	}
+	literal := ep.text[ep.pos:end]
+	if len(literal) < 2 || !isAnonymousLabel(literal[:len(literal)-1]) {
+		return "", false
+	}
+	if suffix := literal[len(literal)-1]; suffix != 'f' && suffix != 'b' {
+		return "", false
+	}
+	ep.pos = end
+	return literal, true
+}
+
+// number parses 13, 0x1F or 0b1010.
+func (ep *exprParser) number() (*expression, error) {
+	start := ep.pos
+	for ep.pos < len(ep.text) && isNameChar(ep.text[ep.pos]) {
+		ep.pos++
+	}
+	literal := ep.text[start:ep.pos]
+	base, digits := 10, literal
+	if len(literal) > 2 && literal[0] == '0' {
+		switch literal[1] {
+		case 'x', 'X':
+			base, digits = 16, literal[2:]
+		case 'b', 'B':
+			base, digits = 2, literal[2:]
+		}
+	}
+	value, err := strconv.ParseInt(digits, base, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", literal)
+	}
+	return &expression{kind: exprNumber, value: int(value)}, nil
+}
+
+// prefixedNumber parses the #d13, #x1F and #b1010 literal forms.
+func (ep *exprParser) prefixedNumber() (*expression, error) {
+	if ep.pos+2 > len(ep.text) {
+		return nil, fmt.Errorf("invalid literal %q", ep.text[ep.pos:])
+	}
+	base := map[byte]int{'d': 10, 'x': 16, 'b': 2}[ep.text[ep.pos+1]]
+	if base == 0 {
+		return nil, fmt.Errorf("invalid literal %q", ep.text[ep.pos:])
+	}
+	ep.pos += 2
+	start := ep.pos
+	if ep.pos < len(ep.text) && ep.text[ep.pos] == '-' {
+		ep.pos++
+	}
+	for ep.pos < len(ep.text) && isNameChar(ep.text[ep.pos]) {
+		ep.pos++
+	}
+	value, err := strconv.ParseInt(ep.text[start:ep.pos], base, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", ep.text[start-2:ep.pos])
+	}
+	return &expression{kind: exprNumber, value: int(value)}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+// bindSymbol returns a reference to name. "." becomes the current location,
+// local and numeric label references are qualified from the current line,
+// and already-defined symbols are bound now.
+func (p *Parser) bindSymbol(name string) *expression {
+	if name == "." {
+		here := &symbol{section: p.section, offset: p.addrCounter}
+		return &expression{kind: exprSymbol, name: name, key: name, sym: here}
+	}
+	key := p.qualify(name)
+	return &expression{kind: exprSymbol, name: name, key: key, sym: p.symbolTable[key]}
+}
+
+// eval computes the expression's value.
+func (e *expression) eval(p *Parser) (int, error) {
+	switch e.kind {
+	case exprNumber:
+		return e.value, nil
+	case exprSymbol:
+		sym := e.sym
+		if sym == nil {
+			sym = p.symbolTable[e.key]
+		}
+		if sym == nil {
+			if p.firstPass {
+				return 0, fmt.Errorf("%s is not defined yet, and this value is needed in the first pass", e.name)
+			}
+			return 0, fmt.Errorf("undefined symbol: %s", e.name)
+		}
+		return p.symbolValue(e.name, sym)
+	case exprUnary, exprCall:
+		v, err := e.left.eval(p)
+		if err != nil {
+			return 0, err
+		}
+		switch e.op {
+		case "-":
+			return -v, nil
+		case "~":
+			return ^v, nil
+		case "lo":
+			return v & 0xFF, nil
+		case "hi":
+			return v >> 8 & 0xFF, nil
+		}
+		return v, nil
+	case exprBinary:
+		l, err := e.left.eval(p)
+		if err != nil {
+			return 0, err
+		}
+		r, err := e.right.eval(p)
+		if err != nil {
+			return 0, err
+		}
+		switch e.op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		case "<<", ">>":
+			if r < 0 {
+				return 0, fmt.Errorf("negative shift count %d", r)
+			}
+			if r >= MAX_SHIFT {
+				return 0, fmt.Errorf("shift count %d is not less than %d", r, MAX_SHIFT)
+			}
+			if e.op == "<<" {
+				return l << r, nil
+			}
+			return l >> r, nil
+		case "&":
+			return l & r, nil
+		case "|":
+			return l | r, nil
+		}
+	}
+	return 0, fmt.Errorf("malformed expression")
+}
+
+// symbolValue returns a label's absolute address or a constant's value.
+func (p *Parser) symbolValue(name string, sym *symbol) (int, error) {
+	if sym.value == nil {
+		if p.firstPass && !sym.section.Fixed {
+			return 0, fmt.Errorf("address of %s in %s is not known until sections are laid out", name, sym.section.Name)
+		}
+		return sym.section.Base + sym.offset, nil
+	}
+	if sym.evaluating {
+		return 0, fmt.Errorf("%s is defined in terms of itself", name)
+	}
+	sym.evaluating = true
+	defer func() { sym.evaluating = false }()
+	return sym.value.eval(p)
+}
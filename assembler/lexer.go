@@ -10,67 +10,208 @@ func Tokenize(source string) []Token {
 	var tokens []Token
 	// Split the input into lines.
 	lines := strings.SplitSeq(source, "\n")
+	lineNumber := 0
 	for line := range lines {
+		lineNumber++
 		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
 		// Skip empty lines or full-line comments.
 		if trimmed == "" || strings.HasPrefix(trimmed, ";") {
 			continue
 		}
-		// Remove inline comments (anything after ';').
-		if idx := strings.Index(trimmed, ";"); idx != -1 {
-			trimmed = strings.TrimSpace(trimmed[:idx])
-		}
-		// Replace commas with spaces to separate tokens like "$r0,".
-		trimmed = strings.ReplaceAll(trimmed, ",", " ")
 
-		// Use a character-based scan to handle string literals that may include spaces.
+		// Use a character-based scan to handle string literals that may include
+		// spaces, commas or semicolons.
+		// On an instruction line #'c' is a character immediate rather than a
+		// string, and after a directive each comma-separated argument is a
+		// single expression token. A line starting with any other identifier
+		// is a macro call whose arguments are kept as raw text.
+		sawOpcode, sawDirective, sawCall := false, false, false
+		column := 0
+		emit := func(token Token) {
+			token.Pos = Pos{Line: lineNumber, Column: column}
+			tokens = append(tokens, token)
+		}
 		i := 0
 		for i < len(trimmed) {
-			// Skip whitespace.
-			if unicode.IsSpace(rune(trimmed[i])) {
+			// Skip whitespace and the commas separating operands like "$r0,".
+			if unicode.IsSpace(rune(trimmed[i])) || trimmed[i] == ',' {
 				i++
 				continue
 			}
+			// The rest of the line is an inline comment.
+			if trimmed[i] == ';' {
+				break
+			}
+			column = indent + i + 1
 
-			// Check if we have a string literal starting with "#'"
-			if i+1 < len(trimmed) && trimmed[i] == '#' && trimmed[i+1] == '\'' {
-				i += 2 // skip "#'"
+			// Check if we have a string literal starting with "#'" or '"'.
+			if !sawCall && ((!sawOpcode && i+1 < len(trimmed) && trimmed[i] == '#' && trimmed[i+1] == '\'') || trimmed[i] == '"') {
+				tokenType, quote := TokenImmAscii, byte('\'')
+				if trimmed[i] == '"' {
+					tokenType, quote = TokenString, '"'
+					i++ // skip '"'
+				} else {
+					i += 2 // skip "#'"
+				}
 				start := i
-				// Read until the closing single quote.
-				for i < len(trimmed) && trimmed[i] != '\'' {
+				// Read until the closing quote, stepping over escapes.
+				for i < len(trimmed) && trimmed[i] != quote {
+					if trimmed[i] == '\\' {
+						i++
+					}
 					i++
 				}
-				if i < len(trimmed) && trimmed[i] == '\'' {
+				if i > len(trimmed) {
+					i = len(trimmed)
+				}
+				if i < len(trimmed) && trimmed[i] == quote {
 					// Extract the string literal value.
-					tokenVal := trimmed[start:i]
-					tokens = append(tokens, Token{Type: TokenImmAscii, Value: tokenVal})
+					tokenVal := unescape(trimmed[start:i])
+					emit(Token{Type: tokenType, Value: tokenVal})
 					i++ // skip the closing quote
 				} else {
 					// Unterminated string literal: take rest of line.
-					tokenVal := trimmed[start:]
-					tokens = append(tokens, Token{Type: TokenImmAscii, Value: tokenVal})
+					tokenVal := unescape(trimmed[start:])
+					emit(Token{Type: tokenType, Value: tokenVal})
 					break
 				}
+			} else if sawCall {
+				start := i
+				i = scanExpression(trimmed, i)
+				emit(Token{Type: TokenExpr, Value: strings.TrimSpace(trimmed[start:i])})
+			} else if sawDirective || trimmed[i] == '#' || trimmed[i] == '=' || trimmed[i] == '^' {
+				// Expressions may contain spaces, so they run to the next comma.
+				start := i
+				i = scanExpression(trimmed, i)
+				emit(classifyExpression(strings.TrimSpace(trimmed[start:i])))
 			} else {
-				// Otherwise, grab a non-string token until next whitespace.
+				// Otherwise, grab a non-string token until the next separator.
 				start := i
-				for i < len(trimmed) && !unicode.IsSpace(rune(trimmed[i])) {
+				for i < len(trimmed) && !unicode.IsSpace(rune(trimmed[i])) && trimmed[i] != ',' && trimmed[i] != ';' {
 					i++
 				}
 				tokenStr := trimmed[start:i]
-				tokens = append(tokens, classifyToken(tokenStr))
+				token := classifyToken(tokenStr)
+				sawOpcode = sawOpcode || token.Type == TokenOpcode
+				sawDirective = sawDirective || token.Type == TokenDirective
+				sawCall = token.Type == TokenIdentifier && !sawOpcode && !sawDirective
+				emit(token)
 			}
 		}
 	}
 	return tokens
 }
 
+// scanExpression returns the index of the comma, comment or end of line
+// that ends the expression starting at i, skipping over parentheses and
+// quoted characters.
+func scanExpression(line string, i int) int {
+	depth := 0
+	for i < len(line) {
+		switch c := line[i]; c {
+		case '\'', '"':
+			i++
+			for i < len(line) && line[i] != c {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',', ';':
+			if depth <= 0 {
+				return i
+			}
+		}
+		i++
+	}
+	return len(line)
+}
+
+// classifyExpression types an operand or directive argument. Plain #d and
+// #x literals keep their own token types; anything else after '#' is an
+// expression immediate, '^' an immediate for the upper byte and '=' takes
+// an expression resolved to an address.
+func classifyExpression(tok string) Token {
+	if strings.HasPrefix(tok, "=") {
+		return Token{Type: TokenLabelImm, Value: strings.TrimSpace(tok[1:])}
+	}
+	if strings.HasPrefix(tok, "^") {
+		// ^ takes the same d and x literals as #.
+		value := strings.TrimSpace(tok[1:])
+		if literal := classifyExpression("#" + value); literal.Type == TokenImmDec || literal.Type == TokenImmHex {
+			value = "#" + value
+		}
+		return Token{Type: TokenImmUpper, Value: value}
+	}
+	if len(tok) > 2 && tok[0] == '#' {
+		literal := tok[2:]
+		switch {
+		case tok[1] == 'd' && isLiteral(strings.TrimPrefix(literal, "-"), "0123456789"):
+			return Token{Type: TokenImmDec, Value: literal}
+		case tok[1] == 'x' && isLiteral(literal, "0123456789abcdefABCDEF"):
+			return Token{Type: TokenImmHex, Value: literal}
+		}
+	}
+	if strings.HasPrefix(tok, "#") {
+		return Token{Type: TokenImmExpr, Value: strings.TrimSpace(tok[1:])}
+	}
+	return Token{Type: TokenExpr, Value: tok}
+}
+
+func isLiteral(literal string, digits string) bool {
+	if literal == "" {
+		return false
+	}
+	for _, c := range literal {
+		if !strings.ContainsRune(digits, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// unescape replaces backslash escapes in a string literal with the
+// characters they stand for. Unknown escapes keep the escaped character.
+func unescape(literal string) string {
+	var b strings.Builder
+	for i := 0; i < len(literal); i++ {
+		c := literal[i]
+		if c != '\\' || i+1 == len(literal) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch literal[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(literal[i])
+		}
+	}
+	return b.String()
+}
+
 // classifyToken examines a token string and determines its type.
 func classifyToken(tok string) Token {
 	// If the token ends with a colon, it's a label definition.
 	if strings.HasSuffix(tok, ":") {
 		return Token{Type: TokenLabel, Value: strings.TrimSuffix(tok, ":")}
 	}
+	// Assembler directives: start with '.', e.g. ".org".
+	if len(tok) > 1 && strings.HasPrefix(tok, ".") {
+		return Token{Type: TokenDirective, Value: tok}
+	}
 	// Register direct: starts with '$'
 	if strings.HasPrefix(tok, "$") {
 		return Token{Type: TokenRegDirect, Value: tok[1:]}
@@ -79,6 +220,14 @@ func classifyToken(tok string) Token {
 	if strings.HasPrefix(tok, "@") {
 		return Token{Type: TokenRegIndirect, Value: tok[1:]}
 	}
+	// Register upper byte: starts with '%'
+	if strings.HasPrefix(tok, "%") {
+		return Token{Type: TokenRegUpper, Value: tok[1:]}
+	}
+	// Register word: starts with '&'
+	if strings.HasPrefix(tok, "&") {
+		return Token{Type: TokenRegWord, Value: tok[1:]}
+	}
 	// Literal immediates that aren’t string literals.
 	if strings.HasPrefix(tok, "#") {
 		if len(tok) < 2 {
@@ -102,6 +251,10 @@ func classifyToken(tok string) Token {
 	if strings.HasPrefix(tok, "=") {
 		return Token{Type: TokenLabelImm, Value: tok[1:]}
 	}
+	// Upper byte immediates: start with '^'.
+	if strings.HasPrefix(tok, "^") {
+		return classifyExpression(tok)
+	}
 	// Opcodes: for our example, we support "mov" and similar.
 	switch tok {
 	case "halt",
@@ -110,7 +263,7 @@ func classifyToken(tok string) Token {
 		"and", "or", "xor", "not", "shl", "shr",
 		"jmp", "je", "jz", "jnz", "jc", "jnc", "call", "ret",
 		"push", "pop",
-		"nop":
+		"nop", "reti":
 		return Token{Type: TokenOpcode, Value: tok}
 	}
 	// Otherwise, treat it as an identifier.
@@ -0,0 +1,377 @@
+package assembler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MAX_EXPANSION_DEPTH bounds nested macro calls so a macro that calls
+// itself is reported instead of expanding forever.
+const MAX_EXPANSION_DEPTH = 64
+
+// MAX_EXPANDED_TOKENS bounds the tokens macros and repetitions may produce
+// in total, so a line such as ".rept 1 << 30" is reported instead of
+// exhausting memory.
+const MAX_EXPANDED_TOKENS = 1 << 20
+
+type macroParam struct {
+	name       string
+	value      string // Default value
+	hasDefault bool
+}
+
+type macro struct {
+	name       string
+	params     []macroParam
+	body       []Token
+	definition Token // The .macro directive
+}
+
+// expansion records which macro call or repetition produced a token, so
+// errors can point at both the definition and the call site.
+type expansion struct {
+	macro      string
+	definition Token
+	call       Token
+	parent     *expansion
+}
+
+func (e *expansion) String() string {
+	return fmt.Sprintf("in %s defined at %s, expanded at %s", e.macro, e.definition.Pos, e.call.Pos)
+}
+
+type expander struct {
+	macros map[string]*macro
+	count  int // Expansions so far, used for \@ unique labels
+	tokens int // Tokens produced by expansions so far
+	errs   ErrorList
+}
+
+// Expand replaces macro calls and .rept/.irp blocks with their bodies:
+//
+//	.macro name param, param=default ... .endm   define a macro
+//	name arg, param=arg                          call it
+//	.rept count ... .endr                        repeat a block
+//	.irp param, value, ... .endr                 repeat once per value
+//
+// In a body \param is replaced by the argument's text and \@ by a number
+// unique to each expansion, for labels local to one call. Macros must be
+// defined before they are called. Tokens from an expansion remember it, so
+// later errors can point at both the definition and the call site.
+func Expand(tokens []Token) ([]Token, error) {
+	e := &expander{macros: make(map[string]*macro)}
+	out := e.expand(tokens, 0)
+	return out, e.errs.err()
+}
+
+func (e *expander) expand(tokens []Token, depth int) []Token {
+	var out []Token
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch {
+		case tok.Type == TokenDirective && tok.Value == ".macro":
+			args, end := arguments(tokens, i+1)
+			body, next, err := block(tokens, end, ".macro", ".endm")
+			if err != nil {
+				e.fail(tok, err)
+				return out
+			}
+			i = next
+			m, err := newMacro(args, body, tok)
+			if err != nil {
+				e.fail(tok, err)
+				continue
+			}
+			e.macros[m.name] = m
+		case tok.Type == TokenDirective && (tok.Value == ".rept" || tok.Value == ".irp"):
+			args, end := arguments(tokens, i+1)
+			body, next, err := block(tokens, end, tok.Value, ".endr")
+			if err != nil {
+				e.fail(tok, err)
+				return out
+			}
+			out = append(out, e.repeat(tok, args, body, depth)...)
+			i = next
+		case tok.Type == TokenDirective && (tok.Value == ".endm" || tok.Value == ".endr"):
+			e.fail(tok, fmt.Errorf("%s without a matching block", tok.Value))
+		case tok.Type == TokenIdentifier && e.macros[tok.Value] != nil:
+			m := e.macros[tok.Value]
+			args, end := arguments(tokens, i+1)
+			i = end - 1
+			site := &expansion{macro: "macro " + m.name, definition: m.definition, call: tok, parent: tok.expansion}
+			if depth >= MAX_EXPANSION_DEPTH {
+				e.nestedTooDeep(tok)
+				continue
+			}
+			bindings, err := m.bind(args)
+			if err != nil {
+				d := errorAt(tok, "%v", err)
+				d.Notes = append([]string{fmt.Sprintf("macro %s defined at %s", m.name, m.definition.Pos)}, d.Notes...)
+				e.errs = append(e.errs, d)
+				continue
+			}
+			out = append(out, e.instantiate(m.body, bindings, site, depth)...)
+		default:
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+// nestedTooDeep reports runaway macro recursion once, at the outermost call.
+func (e *expander) nestedTooDeep(tok Token) {
+	outermost := tok.expansion
+	for outermost.parent != nil {
+		outermost = outermost.parent
+	}
+	e.errs = append(e.errs, &Diagnostic{
+		Pos:     outermost.call.Pos,
+		Message: fmt.Sprintf("macros nested more than %d deep", MAX_EXPANSION_DEPTH),
+		Notes:   []string{outermost.String()},
+	})
+}
+
+// repeat expands a .rept or .irp block.
+func (e *expander) repeat(directive Token, args []Token, body []Token, depth int) []Token {
+	site := &expansion{macro: directive.Value, definition: directive, call: directive, parent: directive.expansion}
+	var out []Token
+	if directive.Value == ".rept" {
+		if len(args) != 1 {
+			e.fail(directive, fmt.Errorf(".rept needs a count"))
+			return nil
+		}
+		count, err := constant(rawText(args[0]))
+		if err != nil {
+			e.fail(args[0], fmt.Errorf(".rept count: %w", err))
+			return nil
+		}
+		if count > MAX_EXPANDED_TOKENS {
+			e.fail(args[0], fmt.Errorf(".rept count %d is more than %d", count, MAX_EXPANDED_TOKENS))
+			return nil
+		}
+		for range count {
+			if e.tokens > MAX_EXPANDED_TOKENS {
+				break
+			}
+			out = append(out, e.instantiate(body, nil, site, depth)...)
+		}
+		return out
+	}
+	if len(args) == 0 || !isName(args[0].Value) {
+		e.fail(directive, fmt.Errorf(".irp needs a parameter name"))
+		return nil
+	}
+	for _, value := range args[1:] {
+		bindings := map[string]string{args[0].Value: rawText(value)}
+		out = append(out, e.instantiate(body, bindings, site, depth)...)
+	}
+	return out
+}
+
+// instantiate substitutes arguments into a copy of body and expands any
+// macro calls it contains.
+func (e *expander) instantiate(body []Token, bindings map[string]string, site *expansion, depth int) []Token {
+	if e.tokens += len(body); e.tokens > MAX_EXPANDED_TOKENS {
+		if e.tokens-len(body) <= MAX_EXPANDED_TOKENS {
+			e.fail(site.call, fmt.Errorf("macros and repetitions produce more than %d tokens", MAX_EXPANDED_TOKENS))
+		}
+		return nil
+	}
+	e.count++
+	unique := strconv.Itoa(e.count)
+	// Each instance is its own expansion, so lines of consecutive
+	// repetitions stay apart.
+	instance := *site
+	site = &instance
+	// Replace longer names first so \a does not clobber \ab.
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	tokens := make([]Token, len(body))
+	opcodeCall := false // A parameter supplied this line's opcode
+	for i, tok := range body {
+		value := tok.Value
+		if tok.Type != TokenString && tok.Type != TokenImmAscii {
+			for _, name := range names {
+				value = strings.ReplaceAll(value, `\`+name, bindings[name])
+			}
+			value = strings.ReplaceAll(value, `\@`, unique)
+		}
+		switch {
+		case tok.Type == TokenExpr && opcodeCall:
+			// The line was lexed as a macro call; lex its arguments as operands.
+			tok = classifyOperand(tok, value)
+		case value != tok.Value:
+			tok = reclassify(tok, value)
+		}
+		if tok.Type != TokenExpr {
+			opcodeCall = tok.Type == TokenOpcode && body[i].Type == TokenIdentifier
+		}
+		tok.expansion = site
+		tokens[i] = tok
+	}
+	return e.expand(tokens, depth+1)
+}
+
+// reclassify types a token again after substitution changed its text, so
+// an argument can supply an opcode or a register. Directive and call
+// arguments stay raw text; the parser reads quoted strings from them.
+func reclassify(tok Token, value string) Token {
+	if tok.Type == TokenIdentifier {
+		return classifyOperand(tok, value)
+	}
+	tok.Value = value
+	return tok
+}
+
+// classifyOperand lexes raw argument text as an instruction operand.
+func classifyOperand(tok Token, value string) Token {
+	retyped := classifyToken(value)
+	if strings.HasPrefix(value, "#") || strings.HasPrefix(value, "=") || strings.HasPrefix(value, "^") {
+		retyped = classifyExpression(value)
+	}
+	tok.Type, tok.Value = retyped.Type, retyped.Value
+	return tok
+}
+
+// bind matches call arguments, positional or name=value, to parameters.
+func (m *macro) bind(args []Token) (map[string]string, error) {
+	bindings := make(map[string]string)
+	for i, arg := range args {
+		text := rawText(arg)
+		if name, value, ok := strings.Cut(text, "="); ok && m.param(strings.TrimSpace(name)) != nil {
+			bindings[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			continue
+		}
+		if i >= len(m.params) {
+			return nil, fmt.Errorf("macro %s takes %d arguments, got %d", m.name, len(m.params), len(args))
+		}
+		bindings[m.params[i].name] = text
+	}
+	for _, param := range m.params {
+		if _, ok := bindings[param.name]; ok {
+			continue
+		}
+		if !param.hasDefault {
+			return nil, fmt.Errorf("macro %s: missing argument %s", m.name, param.name)
+		}
+		bindings[param.name] = param.value
+	}
+	return bindings, nil
+}
+
+func (m *macro) param(name string) *macroParam {
+	for i := range m.params {
+		if m.params[i].name == name {
+			return &m.params[i]
+		}
+	}
+	return nil
+}
+
+// newMacro parses a .macro header. The lexer keeps "name first" together
+// because only commas separate directive arguments.
+func newMacro(args []Token, body []Token, definition Token) (*macro, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf(".macro needs a name")
+	}
+	header := strings.Fields(args[0].Value)
+	m := &macro{name: header[0], body: body, definition: definition}
+	if !isName(m.name) {
+		return nil, fmt.Errorf("invalid macro name %q", m.name)
+	}
+	if _, ok := opcodes[m.name]; ok {
+		return nil, fmt.Errorf("macro %s would hide the opcode of the same name", m.name)
+	}
+	params := header[1:]
+	for _, arg := range args[1:] {
+		params = append(params, rawText(arg))
+	}
+	for _, text := range params {
+		name, value, hasDefault := strings.Cut(text, "=")
+		param := macroParam{name: strings.TrimSpace(name), value: strings.TrimSpace(value), hasDefault: hasDefault}
+		if !isName(param.name) {
+			return nil, fmt.Errorf("macro %s: invalid parameter %q", m.name, param.name)
+		}
+		if m.param(param.name) != nil {
+			return nil, fmt.Errorf("macro %s: duplicate parameter %s", m.name, param.name)
+		}
+		m.params = append(m.params, param)
+	}
+	return m, nil
+}
+
+// arguments returns the argument tokens following a directive or call.
+func arguments(tokens []Token, i int) ([]Token, int) {
+	start := i
+	for i < len(tokens) && isExpression(tokens[i]) {
+		i++
+	}
+	return tokens[start:i], i
+}
+
+// rawText rebuilds the source text of an argument the lexer classified.
+func rawText(tok Token) string {
+	switch tok.Type {
+	case TokenImmDec:
+		return "#d" + tok.Value
+	case TokenImmHex:
+		return "#x" + tok.Value
+	case TokenImmExpr:
+		return "#" + tok.Value
+	case TokenLabelImm:
+		return "=" + tok.Value
+	case TokenImmUpper:
+		return "^" + tok.Value
+	}
+	return tok.Value
+}
+
+// block collects the tokens up to the end directive matching open,
+// allowing nested .rept/.irp blocks. It returns the body and the index of
+// the end directive.
+func block(tokens []Token, i int, open string, end string) ([]Token, int, error) {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		tok := tokens[j]
+		if tok.Type != TokenDirective {
+			continue
+		}
+		switch {
+		case tok.Value == ".macro" && open == ".macro":
+			return nil, 0, fmt.Errorf("macro definitions cannot be nested")
+		case tok.Value == ".rept" || tok.Value == ".irp":
+			if end == ".endr" {
+				depth++
+			}
+		case tok.Value == end:
+			if depth == 0 {
+				return tokens[i:j], j, nil
+			}
+			depth--
+		}
+	}
+	return nil, 0, fmt.Errorf("%s without a matching %s", open, end)
+}
+
+// fail records an error at tok.
+func (e *expander) fail(tok Token, err error) {
+	e.errs = append(e.errs, errorAt(tok, "%v", err))
+}
+
+// constant evaluates an expression that may not refer to any symbol, such
+// as a .rept count, which is needed before parsing starts.
+func constant(text string) (int, error) {
+	p := NewParser(nil)
+	p.firstPass = true
+	expr, err := p.parseExpression(text)
+	if err != nil {
+		return 0, err
+	}
+	return expr.eval(p)
+}
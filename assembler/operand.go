@@ -11,9 +11,15 @@ const (
 	OperandImmAscii
 	OperandLabel
 	OperandLabelImm
+	OperandImmExpr
+	OperandRegUpper
+	OperandRegWord
+	OperandImmUpper
 )
 
 type Operand struct {
-	Type  OperandType
-	Value string
+	Type   OperandType
+	Value  string
+	expr   *expression // Parsed value for label and expression immediates
+	source Token       // Where the operand was written, for diagnostics
 }
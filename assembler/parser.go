@@ -1,7 +1,10 @@
 package assembler
 
 import (
+	"code/g16/cpu"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 func tokenTypeToOperandType(tok TokenType) (OperandType, error) {
@@ -10,6 +13,10 @@ func tokenTypeToOperandType(tok TokenType) (OperandType, error) {
 		return OperandRegDirect, nil
 	case TokenRegIndirect:
 		return OperandRegIndirect, nil
+	case TokenRegUpper:
+		return OperandRegUpper, nil
+	case TokenRegWord:
+		return OperandRegWord, nil
 	case TokenImmDec:
 		return OperandImmDec, nil
 	case TokenImmHex:
@@ -18,117 +25,203 @@ func tokenTypeToOperandType(tok TokenType) (OperandType, error) {
 		return OperandImmAscii, nil
 	case TokenLabelImm:
 		return OperandLabelImm, nil
+	case TokenImmUpper:
+		return OperandImmUpper, nil
+	case TokenImmExpr, TokenExpr:
+		return OperandImmExpr, nil
 	case TokenLabel:
 		return OperandLabel, nil
 	default:
-		return 0, fmt.Errorf("unsupported token type: %s\n", tok)
+		return 0, fmt.Errorf("expected an operand, got %s", tok)
 	}
 }
 
-// DataItem represents a data section item.
+// DataItem represents initialized data placed by a #'...' literal or a
+// data directive. Only one of Data, Bytes and Values is set.
 type DataItem struct {
 	Label   string
-	Data    string
+	Data    string    // Characters stored one per 16-bit word
+	Bytes   []byte    // Literal bytes from .ascii, .fill, .space and .align
+	Values  []Operand // .byte and .word values, resolved like instruction operands
+	Width   int       // Bytes per entry in Values
 	Address int
+	Section string
 }
 
 type Instruction struct {
-	Address  int
-	Opcode   string
-	Operands []Operand
+	Address   int
+	Opcode    string
+	Operands  []Operand
+	Section   string
+	Pos       Pos        // Where the opcode was written
+	expansion *expansion // Macro expansion the instruction came from, if any
+}
+
+// Section is a named region with its own base address and location counter.
+// Sections without an explicit base are laid out after the one before them.
+type Section struct {
+	Name  string
+	Base  int
+	Size  int   // Bytes from Base to the highest location used
+	Fixed bool  // Base was given in the source or defaults to a fixed address
+	Align int   // Largest .align requested, honoured when laying out the base
+	end   Token // Statement that placed the section's last byte, for diagnostics
+}
+
+// Section names in layout order.
+const (
+	SECTION_TEXT = ".text"
+	SECTION_DATA = ".data"
+	SECTION_BSS  = ".bss"
+)
+
+// symbol is a label's location before sections are laid out, or a
+// constant defined with .equ or .set.
+type symbol struct {
+	section     *Section
+	offset      int
+	value       *expression // Set for constants instead of a location
+	redefinable bool        // Defined with .set
+	evaluating  bool        // Guards against constants defined in terms of themselves
+	definition  Token       // Where the symbol was first defined
 }
 
 // Parser holds the list of tokens and a pointer to the current position.
 type Parser struct {
-	tokens        []Token
-	pos           int
-	instructions  []Instruction
-	dataItems     []DataItem
-	symbolTable   map[string]int
-	addrCounter   int
-	inDataSection bool
+	tokens       []Token
+	pos          int
+	instructions []Instruction
+	dataItems    []DataItem
+	symbolTable  map[string]*symbol
+	sections     []*Section
+	section      *Section       // Section being assembled into
+	addrCounter  int            // Byte offset from section.Base
+	lastLabel    string         // Label defined at the current location, if any
+	scope        string         // Last global label, which owns .local labels
+	anonymous    map[string]int // Numeric labels defined so far, by number
+	firstPass    bool           // Label addresses in floating sections are not known yet
+	statement    Token          // Start of the statement being parsed
+	errors       ErrorList
 }
 
 func NewParser(tokens []Token) *Parser {
+	text := &Section{Name: SECTION_TEXT, Base: cpu.PROGRAM_START, Fixed: true}
 	return &Parser{
 		tokens:      tokens,
-		symbolTable: make(map[string]int),
+		symbolTable: make(map[string]*symbol),
+		anonymous:   make(map[string]int),
+		sections: []*Section{
+			text,
+			{Name: SECTION_DATA},
+			{Name: SECTION_BSS},
+		},
+		section: text,
+	}
+}
+
+// Sections returns the sections after Parse has laid them out.
+func (p *Parser) Sections() []Section {
+	sections := make([]Section, len(p.sections))
+	for i, section := range p.sections {
+		sections[i] = *section
 	}
+	return sections
 }
 
-// Parse performs the two-pass parsing.
+// Parse performs the two-pass parsing. A bad statement is reported and
+// the rest of its line skipped, so one run finds as many errors as it can;
+// the error returned is then an ErrorList.
 func (p *Parser) Parse() ([]Instruction, []DataItem, error) {
 	// First pass: build instructions and record label addresses.
+	p.firstPass = true
 	for p.pos < len(p.tokens) {
+		start := p.pos
 		token := p.tokens[p.pos]
-		// If we're in the data section, only accept data tokens.
-		if p.inDataSection {
-			switch token.Type {
-			case TokenImmAscii:
-				// There should be a preceding data label.
-				if len(p.dataItems) == 0 {
-					return nil, nil, fmt.Errorf("data token found without a preceding data label at position %d", p.pos)
-				}
-				// Append the data to the most recent DataItem.
-				lastIndex := len(p.dataItems) - 1
-				p.dataItems[lastIndex].Data += token.Value
-				// Optionally, update the address counter based on data length.
-				p.addrCounter += len(token.Value)
-				p.pos++
-			default:
-				return nil, nil, fmt.Errorf("unexpected token in data section %v at position %d", token, p.pos)
-			}
-			continue
+		p.statement = token
+		if err := p.parseStatement(token); err != nil {
+			p.fail(token, err)
+			p.skipLine(start)
 		}
+	}
 
-		// Not in data section.
-		switch token.Type {
-		case TokenLabel:
-			// Look ahead to see if this label is followed by a data token.
-			if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Type == TokenImmAscii {
-				// This marks the start of a data section.
-				p.symbolTable[token.Value] = p.addrCounter
-				p.dataItems = append(p.dataItems, DataItem{
-					Label:   token.Value,
-					Data:    "", // will be filled by following data tokens.
-					Address: p.addrCounter,
-				})
-				p.inDataSection = true // switch to data mode.
-				p.pos++                // consume the label token.
-			} else {
-				// Otherwise, it's a normal label for instructions.
-				p.symbolTable[token.Value] = p.addrCounter
-				p.pos++
-			}
-		case TokenOpcode:
-			inst, err := p.parseInstruction()
-			if err != nil {
-				return nil, nil, err
-			}
-			inst.Address = p.addrCounter
-			p.addrCounter++ // For simplicity, assume each instruction is 1 word.
-			p.instructions = append(p.instructions, inst)
-		default:
-			return nil, nil, fmt.Errorf("unexpected token %v at position %d", token, p.pos)
-		}
-	}
-
-	// Second pass: resolve label references in instruction operands.
-	for i, inst := range p.instructions {
-		for j, op := range inst.Operands {
-			// Check for label operands that need resolution.
-			labelImm, _ := tokenTypeToOperandType(TokenLabelImm)
-			label, _ := tokenTypeToOperandType(TokenLabel)
-			if op.Type == labelImm || op.Type == label {
-				addr, ok := p.symbolTable[op.Value]
-				if !ok {
-					return nil, nil, fmt.Errorf("undefined label: %s", op.Value)
-				}
-				p.instructions[i].Operands[j].Value = fmt.Sprintf("%d", addr)
-			}
+	if err := p.layout(); err != nil {
+		p.fail(Token{}, err)
+		return nil, nil, p.errors
+	}
+	p.firstPass = false
+
+	// Section offsets become absolute addresses now that bases are known.
+	for i := range p.instructions {
+		p.instructions[i].Address += p.lookupSection(p.instructions[i].Section).Base
+	}
+	for i := range p.dataItems {
+		p.dataItems[i].Address += p.lookupSection(p.dataItems[i].Section).Base
+	}
+
+	// Second pass: resolve label references in instruction and data operands.
+	for i := range p.instructions {
+		p.resolve(p.instructions[i].Operands)
+	}
+	for i := range p.dataItems {
+		p.resolve(p.dataItems[i].Values)
+	}
+	return p.instructions, p.dataItems, p.errors.err()
+}
+
+// parseStatement parses the label, data, instruction or directive at token.
+func (p *Parser) parseStatement(token Token) error {
+	switch token.Type {
+	case TokenLabel:
+		if err := p.define(token); err != nil {
+			return err
+		}
+		p.pos++
+	case TokenImmAscii:
+		// A bare #'...' literal stores each character as a 16-bit word.
+		if err := p.requireInitialized(); err != nil {
+			return err
+		}
+		item := p.newDataItem()
+		item.Data = token.Value
+		p.emit(item, len(token.Value)*cpu.BYTES_PER_WORD)
+		p.pos++
+	case TokenOpcode:
+		if err := p.requireInitialized(); err != nil {
+			return err
+		}
+		if (p.section.Base+p.addrCounter)%cpu.BYTES_PER_WORD != 0 {
+			return fmt.Errorf("instruction at odd address %04X, use .align %d", p.section.Base+p.addrCounter, cpu.BYTES_PER_WORD)
+		}
+		inst, err := p.parseInstruction()
+		if err != nil {
+			return err
 		}
+		inst.Address = p.addrCounter
+		inst.Section = p.section.Name
+		p.advance(cpu.BYTES_PER_WORD)
+		p.instructions = append(p.instructions, inst)
+		return checkOperands(inst)
+	case TokenDirective:
+		return p.parseDirective()
+	default:
+		return fmt.Errorf("unexpected %s %q", token.Type, token.Value)
+	}
+	return nil
+}
+
+// resolve evaluates expression operands, replacing each with its value.
+func (p *Parser) resolve(operands []Operand) {
+	for j, op := range operands {
+		if op.expr == nil {
+			continue
+		}
+		value, err := op.expr.eval(p)
+		if err != nil {
+			p.fail(op.source, err)
+			continue
+		}
+		operands[j].Value = strconv.Itoa(value)
 	}
-	return p.instructions, p.dataItems, nil
 }
 
 // parseInstruction builds an instruction from an opcode and its operands.
@@ -140,23 +233,314 @@ func (p *Parser) parseInstruction() (Instruction, error) {
 	// Expect an opcode.
 	opToken := p.tokens[p.pos]
 	inst.Opcode = opToken.Value
+	inst.Pos = opToken.Pos
+	inst.expansion = opToken.expansion
 	p.pos++
 
-	// Read operands until we reach an opcode or a label token.
-	for p.pos < len(p.tokens) {
+	// Operands run to the end of the opcode's line.
+	for p.pos < len(p.tokens) && sameLine(opToken, p.tokens[p.pos]) {
 		tok := p.tokens[p.pos]
-		if tok.Type == TokenOpcode || tok.Type == TokenLabel {
-			break
+		tokType, err := tokenTypeToOperandType(tok.Type)
+		if err != nil {
+			return inst, errorAt(tok, "%v %q", err, tok.Value)
 		}
-		tokType, _ := tokenTypeToOperandType(tok.Type)
 		operand := Operand{
-			// For simplicity, we reuse the token type.
-			// In a more refined parser, you might map token types to OperandType explicitly.
-			Type:  tokType,
-			Value: tok.Value,
+			Type:   tokType,
+			Value:  tok.Value,
+			source: tok,
+		}
+		if tok.Type == TokenLabelImm || tok.Type == TokenImmExpr || tok.Type == TokenImmUpper {
+			expr, err := p.parseExpression(tok.Value)
+			if err != nil {
+				return inst, p.errorAt(p.pos, "%v", err)
+			}
+			operand.expr = expr
 		}
 		inst.Operands = append(inst.Operands, operand)
 		p.pos++
 	}
 	return inst, nil
 }
+
+// errorAt builds a diagnostic at the token at pos, or at the last token
+// when pos is past the end of input.
+func (p *Parser) errorAt(pos int, format string, args ...any) *Diagnostic {
+	var tok Token
+	switch {
+	case pos < len(p.tokens):
+		tok = p.tokens[pos]
+	case len(p.tokens) > 0:
+		tok = p.tokens[len(p.tokens)-1]
+	}
+	return errorAt(tok, format, args...)
+}
+
+// fail records err, placing it at tok unless it is already a diagnostic.
+func (p *Parser) fail(tok Token, err error) {
+	if d, ok := err.(*Diagnostic); ok {
+		p.errors = append(p.errors, d)
+		return
+	}
+	p.errors = append(p.errors, errorAt(tok, "%v", err))
+}
+
+// skipLine moves past the rest of the line holding the token at start,
+// and always past that token itself.
+func (p *Parser) skipLine(start int) {
+	p.pos = max(p.pos, start+1)
+	for p.pos < len(p.tokens) && sameLine(p.tokens[start], p.tokens[p.pos]) {
+		p.pos++
+	}
+}
+
+// sameLine reports whether two tokens come from the same source line of
+// the same expansion.
+func sameLine(a, b Token) bool {
+	return a.Pos.File == b.Pos.File && a.Pos.Line == b.Pos.Line && a.expansion == b.expansion
+}
+
+// define records a label at the current location. A label starting with
+// '.' is local to the global label before it, and a numeric label such as
+// "1:" may be defined many times and is referred to as 1f or 1b.
+func (p *Parser) define(tok Token) error {
+	name := tok.Value
+	switch {
+	case isAnonymousLabel(name):
+		p.anonymous[name]++
+		name = anonymousKey(name, p.anonymous[name])
+	case strings.HasPrefix(name, "."):
+		if p.scope == "" {
+			return fmt.Errorf("local label %s has no global label before it", name)
+		}
+		name = p.scope + name
+	default:
+		p.scope = name
+	}
+	if old := p.symbolTable[name]; old != nil {
+		return redefined(tok, "label "+name, old)
+	}
+	p.symbolTable[name] = &symbol{section: p.section, offset: p.addrCounter, definition: tok}
+	p.lastLabel = name
+	return nil
+}
+
+// redefined reports a second definition of a symbol at tok.
+func redefined(tok Token, what string, old *symbol) *Diagnostic {
+	d := errorAt(tok, "%s is already defined", what)
+	d.Notes = append([]string{fmt.Sprintf("first defined at %s", old.definition.Pos)}, d.Notes...)
+	return d
+}
+
+// qualify returns the symbol table key a label reference refers to from
+// the current line.
+func (p *Parser) qualify(name string) string {
+	if len(name) > 1 && strings.HasPrefix(name, ".") {
+		return p.scope + name
+	}
+	if len(name) > 1 && isAnonymousLabel(name[:len(name)-1]) {
+		switch name[len(name)-1] {
+		case 'b':
+			return anonymousKey(name[:len(name)-1], p.anonymous[name[:len(name)-1]])
+		case 'f':
+			return anonymousKey(name[:len(name)-1], p.anonymous[name[:len(name)-1]]+1)
+		}
+	}
+	return name
+}
+
+func isAnonymousLabel(name string) bool {
+	return isLiteral(name, "0123456789")
+}
+
+// anonymousKey names the n-th definition of a numeric label. The ':' keeps
+// it from clashing with any name written in source.
+func anonymousKey(label string, n int) string {
+	return label + ":" + strconv.Itoa(n)
+}
+
+// advance moves the location counter forward, growing the current section.
+func (p *Parser) advance(bytes int) {
+	if bytes > 0 {
+		p.lastLabel = ""
+	}
+	p.addrCounter += bytes
+	p.grow(p.addrCounter)
+}
+
+// grow extends the current section to size bytes, remembering the
+// statement responsible.
+func (p *Parser) grow(size int) {
+	if size > p.section.Size {
+		p.section.Size = size
+		p.section.end = p.statement
+	}
+}
+
+func (p *Parser) lookupSection(name string) *Section {
+	for _, section := range p.sections {
+		if section.Name == name {
+			return section
+		}
+	}
+	return nil
+}
+
+// parseDirective handles the section, location and constant directives:
+//
+//	.text [base]  .data [base]  .bss [base]  .org address
+//	.equ name, value  .set name, value
+func (p *Parser) parseDirective() error {
+	directive := p.tokens[p.pos]
+	p.pos++
+	switch directive.Value {
+	case SECTION_TEXT, SECTION_DATA, SECTION_BSS:
+		section := p.lookupSection(directive.Value)
+		if p.pos < len(p.tokens) && isExpression(p.tokens[p.pos]) {
+			base, err := p.number()
+			if err != nil {
+				return err
+			}
+			if section.Size > 0 && base != section.Base {
+				return fmt.Errorf("%s base set to %04X after code was placed at %04X", section.Name, base, section.Base)
+			}
+			section.Base = base
+			section.Fixed = true
+			if section.Size == 0 {
+				section.end = directive
+			}
+		}
+		// Each section keeps its own counter; remember where we left this one.
+		p.section.Size = max(p.section.Size, p.addrCounter)
+		p.section = section
+		p.addrCounter = section.Size
+		p.lastLabel = ""
+	case ".org":
+		address, err := p.number()
+		if err != nil {
+			return err
+		}
+		if !p.section.Fixed {
+			return fmt.Errorf(".org in %s needs a base address, e.g. %s #x8000", p.section.Name, p.section.Name)
+		}
+		offset := address - p.section.Base
+		if offset < p.addrCounter {
+			return fmt.Errorf(".org %04X would move %s backwards from %04X", address, p.section.Name, p.section.Base+p.addrCounter)
+		}
+		p.addrCounter = offset
+		p.grow(offset)
+		p.lastLabel = ""
+	case ".equ", ".set":
+		return p.parseConstant(directive)
+	case ".byte", ".word", ".ascii", ".asciz", ".incbin", ".fill", ".space", ".align":
+		return p.parseData(directive)
+	default:
+		return fmt.Errorf("unknown directive %s", directive.Value)
+	}
+	return nil
+}
+
+// isExpression reports whether tok can be read as a directive argument.
+func isExpression(tok Token) bool {
+	switch tok.Type {
+	case TokenImmDec, TokenImmHex, TokenImmExpr, TokenLabelImm, TokenExpr:
+		return true
+	}
+	return false
+}
+
+// expression consumes a directive argument and parses it.
+func (p *Parser) expression() (*expression, error) {
+	if p.pos >= len(p.tokens) || !isExpression(p.tokens[p.pos]) {
+		return nil, p.errorAt(p.pos, "expected a value")
+	}
+	tok := p.tokens[p.pos]
+	text := tok.Value
+	switch tok.Type {
+	case TokenImmDec:
+		text = "#d" + text
+	case TokenImmHex:
+		text = "#x" + text
+	case TokenExpr:
+		// A macro argument may carry the =label form into a directive.
+		text = strings.TrimPrefix(text, "=")
+	}
+	expr, err := p.parseExpression(text)
+	if err != nil {
+		return nil, p.errorAt(p.pos, "%v", err)
+	}
+	p.pos++
+	return expr, nil
+}
+
+// number consumes a directive argument whose value is needed now, such as
+// an .org address or a .space size.
+func (p *Parser) number() (int, error) {
+	expr, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	value, err := expr.eval(p)
+	if err != nil {
+		return 0, p.errorAt(p.pos-1, "%v", err)
+	}
+	return value, nil
+}
+
+// parseConstant defines a symbol whose value is an expression. .equ
+// symbols cannot be redefined; .set symbols can, and each use sees the
+// definition in effect on its line, or the last one for forward uses.
+func (p *Parser) parseConstant(directive Token) error {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].Type != TokenExpr || !isName(p.tokens[p.pos].Value) {
+		return p.errorAt(p.pos, "%s needs a symbol name", directive.Value)
+	}
+	nameToken := p.tokens[p.pos]
+	name := p.qualify(nameToken.Value)
+	p.pos++
+	value, err := p.expression()
+	if err != nil {
+		return err
+	}
+	redefinable := directive.Value == ".set"
+	if old, ok := p.symbolTable[name]; ok && !(redefinable && old.redefinable) {
+		return redefined(nameToken, directive.Value+" "+name, old)
+	}
+	p.symbolTable[name] = &symbol{value: value, redefinable: redefinable, definition: nameToken}
+	return nil
+}
+
+func isName(text string) bool {
+	if text == "" || text == "." || !isNameStart(text[0]) {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		if !isNameChar(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// layout places sections without a base after the previous section,
+// word aligned, and checks that no two sections overlap.
+func (p *Parser) layout() error {
+	end := 0
+	for _, section := range p.sections {
+		if !section.Fixed {
+			align := max(section.Align, cpu.BYTES_PER_WORD)
+			section.Base = (end + align - 1) / align * align
+		}
+		end = section.Base + section.Size
+	}
+	for i, a := range p.sections {
+		if a.Base+a.Size > 1<<cpu.BITS_PER_WORD {
+			return errorAt(a.end, "section %s ends past the top of memory at 0x%04X", a.Name, a.Base+a.Size)
+		}
+		for _, b := range p.sections[i+1:] {
+			if a.Size > 0 && b.Size > 0 && a.Base < b.Base+b.Size && b.Base < a.Base+a.Size {
+				return errorAt(b.end, "section %s (%04X-%04X) overlaps %s (%04X-%04X)",
+					a.Name, a.Base, a.Base+a.Size-1, b.Name, b.Base, b.Base+b.Size-1)
+			}
+		}
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package assembler
 
+import "fmt"
+
 // TokenType defines the type of token.
 type TokenType string
 
@@ -7,16 +9,42 @@ const (
 	TokenOpcode      TokenType = "OPCODE"
 	TokenRegDirect   TokenType = "REG_DIRECT"
 	TokenRegIndirect TokenType = "REG_INDIRECT"
+	TokenRegUpper    TokenType = "REG_UPPER"
+	TokenRegWord     TokenType = "REG_WORD"
 	TokenImmDec      TokenType = "IMMEDIATE_DEC"
 	TokenImmHex      TokenType = "IMMEDIATE_HEX"
 	TokenImmAscii    TokenType = "IMMEDIATE_ASCII"
+	TokenString      TokenType = "STRING"
+	TokenImmExpr     TokenType = "IMMEDIATE_EXPR"
 	TokenLabelImm    TokenType = "LABEL_IMMEDIATE"
+	TokenImmUpper    TokenType = "IMMEDIATE_UPPER"
+	TokenExpr        TokenType = "EXPRESSION"
 	TokenLabel       TokenType = "LABEL"
+	TokenDirective   TokenType = "DIRECTIVE"
 	TokenIdentifier  TokenType = "IDENTIFIER"
 )
 
 // Token represents a lexical token.
 type Token struct {
-	Type  TokenType
-	Value string
+	Type      TokenType
+	Value     string
+	Pos       Pos        // Where the token starts in its source
+	expansion *expansion // Macro expansion that produced this token, if any
+}
+
+// Pos is a location in assembly source.
+type Pos struct {
+	File   string // Empty for a source string
+	Line   int    // 1-based
+	Column int    // 1-based, in bytes
+}
+
+func (pos Pos) String() string {
+	switch {
+	case pos.Line == 0:
+		return pos.File
+	case pos.File == "":
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
 }
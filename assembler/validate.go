@@ -0,0 +1,114 @@
+package assembler
+
+import "fmt"
+
+// Operand count each format takes.
+var operandCounts = map[format]int{
+	formatNone: 0,
+	formatRX:   1,
+	formatRXRY: 2,
+	formatRLI:  2,
+	formatMOV:  2,
+}
+
+// checkOperands checks an instruction's operand count, addressing modes
+// and register numbers against its opcode. It runs as each instruction is
+// parsed; immediate ranges are checked when encoding, once labels have
+// values.
+func checkOperands(inst Instruction) error {
+	info, ok := opcodes[inst.Opcode]
+	if !ok {
+		return fmt.Errorf("unknown opcode %s", inst.Opcode)
+	}
+	ops := inst.Operands
+	if want := operandCounts[info.format]; len(ops) != want {
+		noun := "operands"
+		if want == 1 {
+			noun = "operand"
+		}
+		return fmt.Errorf("%s: expected %d %s, got %d", inst.Opcode, want, noun, len(ops))
+	}
+	switch info.format {
+	case formatRX, formatRXRY:
+		// The memory mode bits are only used by MOV, so either register
+		// prefix is accepted, e.g. @ry for a jump target.
+		for _, op := range ops {
+			if op.Type == OperandRegUpper || op.Type == OperandRegWord {
+				return errorAt(op.source, "%s: expected a $register or @register, got %s", inst.Opcode, modeName(op.Type))
+			}
+			if err := checkRegister(inst.Opcode, op, R_MAX); err != nil {
+				return err
+			}
+		}
+	case formatRLI:
+		return checkRLI(inst.Opcode, ops[0], ops[1])
+	case formatMOV:
+		dst, src := ops[0], ops[1]
+		if isImmediate(src) {
+			return checkRLI(inst.Opcode, dst, src)
+		}
+		for _, op := range ops {
+			if err := checkRegister(inst.Opcode, op, R_MAX); err != nil {
+				return err
+			}
+		}
+		if _, ok := movModes[[2]OperandType{dst.Type, src.Type}]; !ok {
+			return errorAt(dst.source, "%s: cannot move %s to %s", inst.Opcode, modeName(src.Type), modeName(dst.Type))
+		}
+	}
+	return nil
+}
+
+// checkRLI checks a low register destination and an immediate source.
+func checkRLI(opcode string, dst Operand, src Operand) error {
+	if dst.Type != OperandRegDirect {
+		return errorAt(dst.source, "%s: expected a $register, got %s", opcode, modeName(dst.Type))
+	}
+	if err := checkRegister(opcode, dst, RL_MAX); err != nil {
+		return err
+	}
+	if !isImmediate(src) {
+		return errorAt(src.source, "%s: expected an immediate, got %s", opcode, modeName(src.Type))
+	}
+	// ^i loads the upper byte, which only MOVIU does.
+	if src.Type == OperandImmUpper && opcode != "mov" && opcode != "moviu" {
+		return errorAt(src.source, "%s: %s is only valid with mov and moviu", opcode, modeName(src.Type))
+	}
+	return nil
+}
+
+func checkRegister(opcode string, op Operand, max uint16) error {
+	if _, err := register(op, max); err != nil {
+		return errorAt(op.source, "%s: %v", opcode, err)
+	}
+	return nil
+}
+
+func isImmediate(op Operand) bool {
+	switch op.Type {
+	case OperandImmDec, OperandImmHex, OperandImmExpr, OperandLabelImm, OperandImmUpper:
+		return true
+	}
+	return false
+}
+
+// modeName describes an operand's addressing mode for error messages.
+func modeName(t OperandType) string {
+	switch t {
+	case OperandRegDirect:
+		return "a $register"
+	case OperandRegIndirect:
+		return "an @register"
+	case OperandRegUpper:
+		return "a %register"
+	case OperandRegWord:
+		return "an &register"
+	case OperandImmUpper:
+		return "a ^immediate"
+	case OperandLabelImm:
+		return "an =address"
+	case OperandLabel:
+		return "a label"
+	}
+	return "an immediate"
+}
@@ -2,25 +2,96 @@ package bus
 
 import (
 	"code/g16/console"
+	"code/g16/coproc"
+	"code/g16/disk"
+	"code/g16/framebuffer"
+	"code/g16/gpio"
+	"code/g16/lcd"
+	"code/g16/nic"
+	"code/g16/perf"
+	"code/g16/pic"
 	"code/g16/pins"
+	"code/g16/rng"
+	"code/g16/rtc"
+	"code/g16/semihost"
+	"code/g16/serial"
+	"code/g16/sound"
+	"code/g16/video"
+	"code/g16/watchdog"
 )
 
 type Bus struct {
 	CPU_Pins     *pins.Pins
 	RAM_Pins     *pins.Pins
 	CONSOLE_Pins *pins.Pins
+	RTC_Pins     *pins.Pins
+	FB_Pins      *pins.Pins
+	VIDEO_Pins   *pins.Pins
+	SOUND_Pins   *pins.Pins
+	DISK_Pins    *pins.Pins
+	RNG_Pins     *pins.Pins
+	PIC_Pins     *pins.Pins
+	HOST_Pins    *pins.Pins
+	PERF_Pins    *pins.Pins
+	WDT_Pins     *pins.Pins
+	MATH_Pins    *pins.Pins
+	LCD_Pins     *pins.Pins
+	SERIAL_Pins  *pins.Pins
+	GPIO_Pins    *pins.Pins
+	NIC_Pins     *pins.Pins
+	PIC          *pic.PIC // Receives the device interrupt lines
+	nmiLine      *pins.Pins
+}
+
+// irqLines wires each device's IRQ pin to its PIC input line. The array is
+// keyed by the pic.IRQ_* constants, so two devices sharing a line fail to
+// compile.
+func (bus *Bus) irqLines() [pic.IRQ_LINES]*pins.Pins {
+	return [pic.IRQ_LINES]*pins.Pins{
+		pic.IRQ_RTC:    bus.RTC_Pins,
+		pic.IRQ_FB:     bus.FB_Pins,
+		pic.IRQ_VIDEO:  bus.VIDEO_Pins,
+		pic.IRQ_DISK:   bus.DISK_Pins,
+		pic.IRQ_SERIAL: bus.SERIAL_Pins,
+		pic.IRQ_GPIO:   bus.GPIO_Pins,
+		pic.IRQ_NIC:    bus.NIC_Pins,
+	}
+}
+
+// RegisterNMI connects a device's NMI pin straight to the CPU.
+func (bus *Bus) RegisterNMI(device *pins.Pins) {
+	bus.nmiLine = device
 }
 
 func (bus *Bus) PropagateCycle() {
+	bus.RTC_Pins.Valid = false
+	bus.FB_Pins.Valid = false
+	bus.VIDEO_Pins.Valid = false
+	bus.SOUND_Pins.Valid = false
+	bus.DISK_Pins.Valid = false
+	bus.RNG_Pins.Valid = false
+	bus.PIC_Pins.Valid = false
+	bus.HOST_Pins.Valid = false
+	bus.PERF_Pins.Valid = false
+	bus.WDT_Pins.Valid = false
+	bus.MATH_Pins.Valid = false
+	bus.LCD_Pins.Valid = false
+	bus.SERIAL_Pins.Valid = false
+	bus.GPIO_Pins.Valid = false
+	bus.NIC_Pins.Valid = false
 	if bus.CPU_Pins.Valid {
 		bus.RAM_Pins.RW = bus.CPU_Pins.RW // even if writing to console, CPUs read/write intent must be updated
-		if bus.CPU_Pins.Address == console.CONSOLE_ADDRESS {
-			bus.CONSOLE_Pins.Data = bus.CPU_Pins.Data
-			bus.CONSOLE_Pins.Valid = true
-		} else {
+		address := bus.CPU_Pins.Address
+		switch device := bus.device(address); device {
+		case nil:
 			bus.RAM_Pins.Address = bus.CPU_Pins.Address
 			bus.RAM_Pins.Data = bus.CPU_Pins.Data
 			bus.RAM_Pins.Valid = true
+		case bus.CONSOLE_Pins:
+			bus.CONSOLE_Pins.Data = bus.CPU_Pins.Data
+			bus.CONSOLE_Pins.Valid = true
+		default:
+			forward(bus.CPU_Pins, device)
 		}
 	} else {
 		bus.RAM_Pins.Valid = false
@@ -28,12 +99,128 @@ func (bus *Bus) PropagateCycle() {
 	}
 }
 
+// device returns the pins of the device mapped at address, or nil for RAM.
+func (bus *Bus) device(address uint16) *pins.Pins {
+	switch {
+	case address == console.CONSOLE_ADDRESS:
+		return bus.CONSOLE_Pins
+	case inRange(address, rtc.RTC_ADDRESS, rtc.RTC_SIZE):
+		return bus.RTC_Pins
+	case inRange(address, framebuffer.FRAMEBUFFER_ADDRESS, framebuffer.FRAMEBUFFER_SIZE),
+		inRange(address, framebuffer.REGISTER_ADDRESS, framebuffer.REGISTER_SIZE):
+		return bus.FB_Pins
+	case inRange(address, video.VIDEO_ADDRESS, video.VIDEO_SIZE):
+		return bus.VIDEO_Pins
+	case inRange(address, sound.SOUND_ADDRESS, sound.SOUND_SIZE):
+		return bus.SOUND_Pins
+	case inRange(address, disk.DISK_ADDRESS, disk.DISK_SIZE):
+		return bus.DISK_Pins
+	case inRange(address, rng.RNG_ADDRESS, rng.RNG_SIZE):
+		return bus.RNG_Pins
+	case inRange(address, pic.PIC_ADDRESS, pic.PIC_SIZE):
+		return bus.PIC_Pins
+	case inRange(address, semihost.SEMIHOST_ADDRESS, semihost.SEMIHOST_SIZE):
+		return bus.HOST_Pins
+	case inRange(address, perf.PERF_ADDRESS, perf.PERF_SIZE):
+		return bus.PERF_Pins
+	case inRange(address, watchdog.WATCHDOG_ADDRESS, watchdog.WATCHDOG_SIZE):
+		return bus.WDT_Pins
+	case inRange(address, coproc.COPROC_ADDRESS, coproc.COPROC_SIZE):
+		return bus.MATH_Pins
+	case inRange(address, lcd.LCD_ADDRESS, lcd.LCD_SIZE):
+		return bus.LCD_Pins
+	case inRange(address, serial.SERIAL_ADDRESS, serial.SERIAL_SIZE):
+		return bus.SERIAL_Pins
+	case inRange(address, gpio.GPIO_ADDRESS, gpio.GPIO_SIZE):
+		return bus.GPIO_Pins
+	case inRange(address, nic.NIC_ADDRESS, nic.NIC_SIZE):
+		return bus.NIC_Pins
+	}
+	return nil
+}
+
+// IsRAM reports whether the bus routes address to RAM rather than to a
+// device, for devices that move data straight in and out of RAM.
+func (bus *Bus) IsRAM(address uint16) bool {
+	return bus.device(address) == nil
+}
+
 func (bus *Bus) ReturnCycle() {
+	switch {
+	case bus.RTC_Pins.Valid && bus.RTC_Pins.RW:
+		bus.CPU_Pins.Data = bus.RTC_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.FB_Pins.Valid && bus.FB_Pins.RW:
+		bus.CPU_Pins.Data = bus.FB_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.VIDEO_Pins.Valid && bus.VIDEO_Pins.RW:
+		bus.CPU_Pins.Data = bus.VIDEO_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.SOUND_Pins.Valid && bus.SOUND_Pins.RW:
+		bus.CPU_Pins.Data = bus.SOUND_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.DISK_Pins.Valid && bus.DISK_Pins.RW:
+		bus.CPU_Pins.Data = bus.DISK_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.RNG_Pins.Valid && bus.RNG_Pins.RW:
+		bus.CPU_Pins.Data = bus.RNG_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.PIC_Pins.Valid && bus.PIC_Pins.RW:
+		bus.CPU_Pins.Data = bus.PIC_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.HOST_Pins.Valid && bus.HOST_Pins.RW:
+		bus.CPU_Pins.Data = bus.HOST_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.PERF_Pins.Valid && bus.PERF_Pins.RW:
+		bus.CPU_Pins.Data = bus.PERF_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.WDT_Pins.Valid && bus.WDT_Pins.RW:
+		bus.CPU_Pins.Data = bus.WDT_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.MATH_Pins.Valid && bus.MATH_Pins.RW:
+		bus.CPU_Pins.Data = bus.MATH_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.LCD_Pins.Valid && bus.LCD_Pins.RW:
+		bus.CPU_Pins.Data = bus.LCD_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.SERIAL_Pins.Valid && bus.SERIAL_Pins.RW:
+		bus.CPU_Pins.Data = bus.SERIAL_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.GPIO_Pins.Valid && bus.GPIO_Pins.RW:
+		bus.CPU_Pins.Data = bus.GPIO_Pins.Data
+		bus.CPU_Pins.Valid = true
+	case bus.NIC_Pins.Valid && bus.NIC_Pins.RW:
+		bus.CPU_Pins.Data = bus.NIC_Pins.Data
+		bus.CPU_Pins.Valid = true
 	// If RAM was in read mode and valid, return data to CPU
-	if bus.RAM_Pins.Valid && bus.RAM_Pins.RW {
+	case bus.RAM_Pins.Valid && bus.RAM_Pins.RW:
 		bus.CPU_Pins.Data = bus.RAM_Pins.Data
 		bus.CPU_Pins.Valid = true
-	} else {
+	default:
 		bus.CPU_Pins.Valid = false
 	}
+
+	// Sample the device interrupt lines and pass the PIC's decision on to the CPU
+	var requests uint16
+	for line, device := range bus.irqLines() {
+		if device != nil && device.IRQ {
+			requests |= 1 << line
+		}
+	}
+	bus.PIC.Request(requests)
+	bus.CPU_Pins.IRQ = bus.PIC_Pins.IRQ
+	bus.CPU_Pins.NMI = bus.nmiLine != nil && bus.nmiLine.NMI
+}
+
+// inRange reports whether address falls inside a device's register window.
+func inRange(address uint16, base uint16, size uint16) bool {
+	return address >= base && address-base < size
+}
+
+// forward copies the CPU's bus cycle onto a device's pins.
+func forward(from *pins.Pins, to *pins.Pins) {
+	to.Address = from.Address
+	to.Data = from.Data
+	to.RW = from.RW
+	to.Valid = true
 }
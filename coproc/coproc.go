@@ -0,0 +1,291 @@
+package coproc
+
+import (
+	"code/g16/pins"
+	"log"
+	"math"
+)
+
+const COPROC_ADDRESS = 0xEA00
+const COPROC_SIZE = 0x14
+
+const ( // Register offsets from COPROC_ADDRESS, one word each
+	COPROC_A_LO      = 0x00
+	COPROC_A_HI      = 0x02
+	COPROC_B_LO      = 0x04
+	COPROC_B_HI      = 0x06
+	COPROC_OP        = 0x08 // Writing an operation starts it
+	COPROC_STATUS    = 0x0A
+	COPROC_RESULT_LO = 0x0C
+	COPROC_RESULT_HI = 0x0E
+	COPROC_EXTRA_LO  = 0x10 // High half of products, remainders of integer division
+	COPROC_EXTRA_HI  = 0x12
+)
+
+// Operations. Integer and Q16.16 operands are 32 bits wide (LO, HI); Q8.8 and
+// half floats use only the LO word; single floats are IEEE binary32 bit patterns.
+const (
+	OP_MUL    uint16 = iota + 1 // Unsigned 32x32, 64-bit product in RESULT and EXTRA
+	OP_IMUL                     // Signed 32x32, 64-bit product in RESULT and EXTRA
+	OP_DIV                      // Unsigned, quotient in RESULT and remainder in EXTRA
+	OP_IDIV                     // Signed, quotient in RESULT and remainder in EXTRA
+	OP_QMUL8                    // Q8.8, saturating on overflow
+	OP_QDIV8                    // Q8.8, saturating on overflow
+	OP_QMUL16                   // Q16.16, saturating on overflow
+	OP_QDIV16                   // Q16.16, saturating on overflow
+	OP_HADD                     // Half float
+	OP_HSUB                     // Half float
+	OP_HMUL                     // Half float
+	OP_HDIV                     // Half float
+	OP_FADD                     // Single float
+	OP_FSUB                     // Single float
+	OP_FMUL                     // Single float
+	OP_FDIV                     // Single float
+	OP_ITOF                     // Signed 32-bit integer A to single float
+	OP_FTOI                     // Single float A to signed 32-bit integer, truncating
+	OP_HTOF                     // Half float A to single float
+	OP_FTOH                     // Single float A to half float
+)
+
+const (
+	STATUS_BUSY  uint16 = 1 << 0
+	STATUS_ERROR uint16 = 1 << 1 // Division by zero, fixed-point overflow, unknown operation, or unrepresentable conversion
+)
+
+const DEFAULT_LATENCY = 8 // Device cycles from writing OP to the result being ready
+
+type Coproc struct {
+	Pins    *pins.Pins
+	Latency uint64
+	a       uint32
+	b       uint32
+	op      uint16
+	status  uint16
+	result  uint32
+	extra   uint32
+	wait    uint64
+}
+
+func (c *Coproc) ProcessCycle() {
+	c.tick()
+
+	if !c.Pins.Valid {
+		return
+	}
+
+	reg := c.Pins.Address - COPROC_ADDRESS
+	if c.Pins.RW { // Read
+		switch reg {
+		case COPROC_A_LO, COPROC_A_HI:
+			c.Pins.Data = half(c.a, reg == COPROC_A_HI)
+		case COPROC_B_LO, COPROC_B_HI:
+			c.Pins.Data = half(c.b, reg == COPROC_B_HI)
+		case COPROC_OP:
+			c.Pins.Data = c.op
+		case COPROC_STATUS:
+			c.Pins.Data = c.status
+		case COPROC_RESULT_LO, COPROC_RESULT_HI:
+			c.Pins.Data = half(c.result, reg == COPROC_RESULT_HI)
+		case COPROC_EXTRA_LO, COPROC_EXTRA_HI:
+			c.Pins.Data = half(c.extra, reg == COPROC_EXTRA_HI)
+		default:
+			log.Printf("Coproc: read from unmapped register %02X\n", reg)
+			c.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case COPROC_A_LO, COPROC_A_HI:
+			c.a = setHalf(c.a, c.Pins.Data, reg == COPROC_A_HI)
+		case COPROC_B_LO, COPROC_B_HI:
+			c.b = setHalf(c.b, c.Pins.Data, reg == COPROC_B_HI)
+		case COPROC_OP:
+			c.op = c.Pins.Data
+			c.status = STATUS_BUSY
+			c.wait = c.Latency
+		default:
+			log.Printf("Coproc: write %04X to read-only register %02X ignored\n", c.Pins.Data, reg)
+		}
+		c.Pins.Valid = false
+	}
+}
+
+func half(value uint32, high bool) uint16 {
+	if high {
+		return uint16(value >> 16)
+	}
+	return uint16(value)
+}
+
+func setHalf(value uint32, data uint16, high bool) uint32 {
+	if high {
+		return value&0x0000FFFF | uint32(data)<<16
+	}
+	return value&0xFFFF0000 | uint32(data)
+}
+
+func (c *Coproc) tick() {
+	if c.status&STATUS_BUSY == 0 {
+		return
+	}
+	if c.wait > 0 {
+		c.wait--
+		return
+	}
+	c.status = 0
+	if !c.execute() {
+		log.Printf("Coproc: operation %d failed on %08X, %08X\n", c.op, c.a, c.b)
+		c.status = STATUS_ERROR
+	}
+}
+
+// execute performs the pending operation, reporting false on error.
+func (c *Coproc) execute() bool {
+	c.result, c.extra = 0, 0
+	a, b := c.a, c.b
+	switch c.op {
+	case OP_MUL:
+		product := uint64(a) * uint64(b)
+		c.result, c.extra = uint32(product), uint32(product>>32)
+	case OP_IMUL:
+		product := uint64(int64(int32(a)) * int64(int32(b)))
+		c.result, c.extra = uint32(product), uint32(product>>32)
+	case OP_DIV:
+		if b == 0 {
+			return false
+		}
+		c.result, c.extra = a/b, a%b
+	case OP_IDIV:
+		if b == 0 {
+			return false
+		}
+		c.result, c.extra = uint32(int32(a)/int32(b)), uint32(int32(a)%int32(b))
+	case OP_QMUL8:
+		q, ok := saturate(int64(int16(a))*int64(int16(b))>>8, 16)
+		c.result = uint32(uint16(q))
+		return ok
+	case OP_QDIV8:
+		if int16(b) == 0 {
+			return false
+		}
+		q, ok := saturate(int64(int16(a))<<8/int64(int16(b)), 16)
+		c.result = uint32(uint16(q))
+		return ok
+	case OP_QMUL16:
+		q, ok := saturate(int64(int32(a))*int64(int32(b))>>16, 32)
+		c.result = uint32(q)
+		return ok
+	case OP_QDIV16:
+		if b == 0 {
+			return false
+		}
+		q, ok := saturate(int64(int32(a))<<16/int64(int32(b)), 32)
+		c.result = uint32(q)
+		return ok
+	case OP_HADD, OP_HSUB, OP_HMUL, OP_HDIV:
+		x, y := HalfToFloat32(uint16(a)), HalfToFloat32(uint16(b))
+		c.result = uint32(Float32ToHalf(arithmetic(c.op-OP_HADD, x, y)))
+	case OP_FADD, OP_FSUB, OP_FMUL, OP_FDIV:
+		x, y := math.Float32frombits(a), math.Float32frombits(b)
+		c.result = math.Float32bits(arithmetic(c.op-OP_FADD, x, y))
+	case OP_ITOF:
+		c.result = math.Float32bits(float32(int32(a)))
+	case OP_FTOI:
+		f := math.Float32frombits(a)
+		if math.IsNaN(float64(f)) || f >= math.MaxInt32 || f < math.MinInt32 {
+			return false
+		}
+		c.result = uint32(int32(f))
+	case OP_HTOF:
+		c.result = math.Float32bits(HalfToFloat32(uint16(a)))
+	case OP_FTOH:
+		c.result = uint32(Float32ToHalf(math.Float32frombits(a)))
+	default:
+		return false
+	}
+	return true
+}
+
+// saturate clamps a fixed-point result to a signed bits-wide register,
+// reporting false if it had to.
+func saturate(value int64, bits uint) (int64, bool) {
+	high := int64(1)<<(bits-1) - 1
+	low := -high - 1
+	switch {
+	case value > high:
+		return high, false
+	case value < low:
+		return low, false
+	}
+	return value, true
+}
+
+// arithmetic applies add, subtract, multiply or divide, in operation order.
+func arithmetic(n uint16, x float32, y float32) float32 {
+	switch n {
+	case 0:
+		return x + y
+	case 1:
+		return x - y
+	case 2:
+		return x * y
+	default:
+		return x / y
+	}
+}
+
+// HalfToFloat32 widens an IEEE binary16 bit pattern.
+func HalfToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1F
+	mant := uint32(h & 0x3FF)
+	switch exp {
+	case 0: // Zero or subnormal, mant * 2^-24
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1F: // Infinity or NaN
+		return math.Float32frombits(sign | 0x7F800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
+
+// Float32ToHalf narrows to an IEEE binary16 bit pattern, rounding to nearest even.
+func Float32ToHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xFF
+	mant := bits & 0x7FFFFF
+
+	if exp == 0xFF { // Infinity or NaN
+		if mant != 0 {
+			return sign | 0x7E00
+		}
+		return sign | 0x7C00
+	}
+	e := exp - 127 + 15
+	if e >= 0x1F { // Too large, becomes infinity
+		return sign | 0x7C00
+	}
+	if e <= 0 { // Subnormal or zero
+		if e < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - e)
+		h := mant >> shift
+		rem := mant & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if rem > halfway || (rem == halfway && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+	h := uint32(e)<<10 | mant>>13
+	rem := mant & 0x1FFF
+	if rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+		h++ // May carry into the exponent, which rounds up to infinity correctly
+	}
+	return sign | uint16(h)
+}
@@ -16,6 +16,26 @@ const RL_WIDTH = 3
 const I_OFFSET = 0
 const I_WIDTH = 8
 const HIGHBYTE_OFFSET = 8
+const VECTOR_TABLE = 0x0200 // One handler address per interrupt vector
+const NMI_VECTOR = 0x00FE
+
+type ResetCause int
+
+const (
+	PowerOnReset ResetCause = iota
+	WatchdogReset
+)
+
+func (cause ResetCause) String() string {
+	switch cause {
+	case PowerOnReset:
+		return "power-on"
+	case WatchdogReset:
+		return "watchdog"
+	default:
+		return "unknown"
+	}
+}
 
 type CPUState int
 
@@ -24,4 +44,5 @@ const (
 	DecodeInstruction
 	ExecuteInstruction
 	Halted
+	ServiceInterrupt
 )
@@ -2,6 +2,7 @@ package cpu
 
 import (
 	. "code/g16/isa"
+	"code/g16/pic"
 	"code/g16/pins"
 	"fmt"
 	"log"
@@ -17,8 +18,31 @@ type CPU struct {
 	ry        uint16
 	i         uint16
 	iiPending bool
+	rtPending bool // RETI has popped RPC and is waiting to pop RF
+	intStep   int  // Bus cycle within the interrupt entry sequence
+	vector    uint16
+	nmiLine   bool // NMI level seen last cycle, for edge detection
+	nmiLatch  bool // NMI edge seen, taken at the next instruction boundary
+	resetting bool // Reset mid-cycle, so the bus cycle in flight must be dropped
 	up        uint64
+	perf      PerfCounters
 	Halt      bool
+	LastReset ResetCause
+}
+
+// PerfCounters are running totals since the CPU was created.
+type PerfCounters struct {
+	Cycles  uint64 // Half-cycles, as counted by SetupCycle and CompleteCycle
+	Retired uint64 // Instructions that finished executing
+	Reads   uint64 // Bus read cycles issued
+	Writes  uint64 // Bus write cycles issued
+	Stalls  uint64 // Bus cycles spent on data and interrupt entry rather than fetching
+}
+
+func (cpu *CPU) Counters() PerfCounters {
+	counters := cpu.perf
+	counters.Cycles = cpu.up
+	return counters
 }
 
 func (cpu *CPU) SetupCycle() {
@@ -31,6 +55,28 @@ func (cpu *CPU) SetupCycle() {
 		cpu.Pins.Address = cpu.reg[RPC]
 		cpu.Pins.RW = true // Read
 		cpu.Pins.Valid = true
+	case ServiceInterrupt:
+		switch cpu.intStep {
+		case 0:
+			log.Printf("State: Interrupt, acknowledging interrupt from PIC\n")
+			cpu.Pins.Address = pic.PIC_ADDRESS + pic.PIC_ACK
+			cpu.Pins.RW = true // Read
+		case 1:
+			log.Printf("State: Interrupt, pushing RF (%04X)\n", cpu.reg[RF])
+			cpu.Pins.Address = cpu.reg[RSP] - BYTES_PER_WORD
+			cpu.Pins.Data = cpu.reg[RF]
+			cpu.Pins.RW = false // Write
+		case 2:
+			log.Printf("State: Interrupt, pushing RPC (%04X)\n", cpu.reg[RPC])
+			cpu.Pins.Address = cpu.reg[RSP] - BYTES_PER_WORD
+			cpu.Pins.Data = cpu.reg[RPC]
+			cpu.Pins.RW = false // Write
+		case 3:
+			log.Printf("State: Interrupt, reading handler for vector %d\n", cpu.vector)
+			cpu.Pins.Address = VECTOR_TABLE + cpu.vector*BYTES_PER_WORD
+			cpu.Pins.RW = true // Read
+		}
+		cpu.Pins.Valid = true
 	case ExecuteInstruction: // Memory not ready
 		log.Printf("State: Execute, switching on OP: %04X\n", cpu.op)
 		switch cpu.op {
@@ -99,18 +145,47 @@ func (cpu *CPU) SetupCycle() {
 			} else {
 				log.Printf("Not jumping")
 			}
+		case RETI:
+			log.Printf("Executing RETI, popping from @%04X", cpu.reg[RSP])
+			cpu.Pins.Address = cpu.reg[RSP]
+			cpu.Pins.RW = true // Read
+			cpu.Pins.Valid = true
 		default:
 			cpu.Halt = true
 			log.Printf("Panic during execute after %d cycles due to unrecognized OP: %02X\n", cpu.up, cpu.op)
 		}
 
 	}
+
+	if cpu.Pins.Valid {
+		if cpu.Pins.RW {
+			cpu.perf.Reads++
+		} else {
+			cpu.perf.Writes++
+		}
+		if cpu.State != FetchInstruction {
+			cpu.perf.Stalls++
+		}
+	}
 }
 
 func (cpu *CPU) CompleteCycle() {
 	log.Printf("Cycle (complete): %d\n", cpu.up)
 	cpu.up++
 
+	if cpu.Pins.NMI && !cpu.nmiLine {
+		log.Printf("NMI requested")
+		cpu.nmiLatch = true
+	}
+	cpu.nmiLine = cpu.Pins.NMI
+
+	if cpu.resetting {
+		log.Printf("Reset during cycle, dropping bus cycle in flight")
+		cpu.resetting = false
+		cpu.Pins.Valid = false
+		return
+	}
+
 	if cpu.Pins.Valid && cpu.Pins.RW { // Read Operation
 		switch cpu.State {
 		case FetchInstruction:
@@ -152,9 +227,29 @@ func (cpu *CPU) CompleteCycle() {
 					cpu.Halt = true
 					fmt.Printf("Panic during MOV execute after %d cycles due to unrecognized FLAG: %02X\n", cpu.up, cpu.f)
 				}
+			case RETI:
+				if !cpu.rtPending {
+					log.Printf("Executing RETI, restoring RPC <- %04X", cpu.Pins.Data)
+					cpu.reg[RPC] = cpu.Pins.Data
+					cpu.rtPending = true
+				} else {
+					log.Printf("Executing RETI, restoring RF <- %04X", cpu.Pins.Data)
+					cpu.reg[RF] = cpu.Pins.Data
+					cpu.rtPending = false
+				}
+				cpu.reg[RSP] += BYTES_PER_WORD
+				cpu.Pins.Valid = false
 			default:
 				fmt.Printf("Warning, didn't implement opcode to handle memory read, %04X", cpu.op)
 			}
+		case ServiceInterrupt:
+			switch cpu.intStep {
+			case 0:
+				cpu.vector = cpu.Pins.Data
+			case 3:
+				cpu.reg[RPC] = cpu.Pins.Data
+			}
+			cpu.Pins.Valid = false
 		}
 	} else if !cpu.Pins.Valid && !cpu.Pins.RW {
 		switch cpu.op {
@@ -177,7 +272,7 @@ func (cpu *CPU) CompleteCycle() {
 		log.Printf("Decoded OP: %04X\n", cpu.op)
 
 		switch cpu.op {
-		case HALT:
+		case HALT, RETI:
 			// nothing to do
 		case MOV, JZ, JNZ: // $RX $RY
 			log.Printf("Decoding MOV/JNZ OP (0x0001/21/22)")
@@ -198,23 +293,69 @@ func (cpu *CPU) CompleteCycle() {
 		log.Printf("Done decoding, changing state to Execute")
 		cpu.State = ExecuteInstruction
 	case ExecuteInstruction:
-		if cpu.op == MOV && cpu.f == II && cpu.iiPending {
+		switch {
+		case cpu.op == MOV && cpu.f == II && cpu.iiPending:
 			// Remain in ExecuteInstruction to process the write cycle.
 			log.Printf("State: Execute, MOV II: Still in indirect operation; remaining in ExecuteInstruction state.")
-		} else {
+		case cpu.op == RETI && cpu.rtPending:
+			log.Printf("State: Execute, RETI: RF still to pop; remaining in ExecuteInstruction state.")
+		case cpu.nmiLatch:
+			log.Printf("Done executing, NMI pending, changing state to ServiceInterrupt")
+			cpu.perf.Retired++
+			cpu.nmiLatch = false
+			cpu.State = ServiceInterrupt
+			cpu.vector = NMI_VECTOR
+			cpu.intStep = 1 // Non-maskable interrupts skip the PIC acknowledge
+		case cpu.Pins.IRQ && cpu.reg[RF]&FINTERRUPT != 0:
+			log.Printf("Done executing, interrupt requested, changing state to ServiceInterrupt")
+			cpu.perf.Retired++
+			cpu.State = ServiceInterrupt
+			cpu.intStep = 0
+		default:
 			log.Printf("Done executing, changing state to Fetch")
+			cpu.perf.Retired++
+			cpu.State = FetchInstruction
+		}
+	case ServiceInterrupt:
+		switch cpu.intStep {
+		case 1:
+			cpu.reg[RSP] -= BYTES_PER_WORD
+			cpu.reg[RF] &^= FINTERRUPT // Handlers start with interrupts disabled
+		case 2:
+			cpu.reg[RSP] -= BYTES_PER_WORD
+		case 3:
+			log.Printf("Entering interrupt handler at %04X, changing state to Fetch", cpu.reg[RPC])
 			cpu.State = FetchInstruction
 		}
+		cpu.intStep++
 	}
 }
 
 func (cpu *CPU) Reset() {
+	cpu.ResetFrom(PowerOnReset)
+}
+
+// ResetFrom resets the CPU, abandoning any instruction in progress, and records why.
+func (cpu *CPU) ResetFrom(cause ResetCause) {
+	if cause != PowerOnReset {
+		fmt.Printf("Reset by %s after %d cycles at %04X.\n", cause, cpu.up, cpu.reg[RPC])
+	}
 	for i := range cpu.reg {
 		cpu.reg[i] = 0
 	}
 	cpu.reg[RSP] = STACK_TOP     // Initialize the Stack Pointer
 	cpu.reg[RPC] = PROGRAM_START // Start execution at address 0x0200
 	cpu.Halt = false
+	cpu.State = FetchInstruction
+	cpu.iiPending = false
+	cpu.rtPending = false
+	cpu.nmiLatch = false
+	cpu.intStep = 0
+	if cpu.Pins != nil {
+		cpu.Pins.Valid = false
+	}
+	cpu.resetting = cause != PowerOnReset
+	cpu.LastReset = cause
 }
 
 func (cpu *CPU) DumpReg() {
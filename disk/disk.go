@@ -0,0 +1,188 @@
+package disk
+
+import (
+	"code/g16/pins"
+	"code/g16/ram"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const DISK_ADDRESS = 0xE400
+const DISK_SIZE = 0x0C
+const SECTOR_SIZE = 512
+
+const ( // Register offsets from DISK_ADDRESS, one word each
+	DISK_SECTOR_LO = 0x00
+	DISK_SECTOR_HI = 0x02
+	DISK_BUFFER    = 0x04 // RAM address the sector is transferred to or from
+	DISK_COMMAND   = 0x06 // Writing a command starts the transfer
+	DISK_STATUS    = 0x08 // Write 1s to clear DONE and ERROR
+	DISK_CONTROL   = 0x0A
+)
+
+const (
+	COMMAND_READ  uint16 = 1
+	COMMAND_WRITE uint16 = 2
+)
+
+const (
+	STATUS_BUSY  uint16 = 1 << 0
+	STATUS_DONE  uint16 = 1 << 1
+	STATUS_ERROR uint16 = 1 << 2
+)
+
+const CONTROL_IRQ uint16 = 1 << 0
+
+const DEFAULT_LATENCY = 100 // Device cycles from command to completion
+
+type Disk struct {
+	Pins    *pins.Pins
+	Memory  *[ram.RAM_SIZE]byte       // Transfers go straight to RAM, bypassing the bus
+	IsRAM   func(address uint16) bool // Reports addresses the bus routes to RAM; buffers must lie there
+	Latency uint64
+	image   *os.File
+	sector  uint32
+	buffer  uint16
+	command uint16
+	control uint16
+	status  uint16
+	wait    uint64
+}
+
+// Open attaches an existing host image file. It is not created, so a
+// mistyped path is an error rather than an empty disk.
+func (d *Disk) Open(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	d.image = file
+	log.Printf("Disk: attached image %s\n", path)
+	return nil
+}
+
+func (d *Disk) Close() error {
+	if d.image == nil {
+		return nil
+	}
+	err := d.image.Close()
+	d.image = nil
+	return err
+}
+
+func (d *Disk) ProcessCycle() {
+	d.tick()
+
+	if !d.Pins.Valid {
+		return
+	}
+
+	reg := d.Pins.Address - DISK_ADDRESS
+	if d.Pins.RW { // Read
+		d.Pins.Data = d.read(reg)
+	} else { // Write
+		d.write(reg, d.Pins.Data)
+		d.Pins.Valid = false
+	}
+}
+
+func (d *Disk) read(reg uint16) uint16 {
+	switch reg {
+	case DISK_SECTOR_LO:
+		return uint16(d.sector)
+	case DISK_SECTOR_HI:
+		return uint16(d.sector >> 16)
+	case DISK_BUFFER:
+		return d.buffer
+	case DISK_COMMAND:
+		return d.command
+	case DISK_STATUS:
+		return d.status
+	case DISK_CONTROL:
+		return d.control
+	default:
+		log.Printf("Disk: read from unmapped register %02X\n", reg)
+		return 0
+	}
+}
+
+func (d *Disk) write(reg uint16, data uint16) {
+	if d.status&STATUS_BUSY != 0 && reg != DISK_STATUS && reg != DISK_CONTROL {
+		log.Printf("Disk: write %04X to register %02X ignored while busy\n", data, reg)
+		return
+	}
+	switch reg {
+	case DISK_SECTOR_LO:
+		d.sector = d.sector&0xFFFF0000 | uint32(data)
+	case DISK_SECTOR_HI:
+		d.sector = d.sector&0x0000FFFF | uint32(data)<<16
+	case DISK_BUFFER:
+		d.buffer = data
+	case DISK_COMMAND:
+		d.command = data
+		d.status = d.status&^(STATUS_DONE|STATUS_ERROR) | STATUS_BUSY
+		d.wait = d.Latency
+	case DISK_STATUS:
+		d.status &^= data & (STATUS_DONE | STATUS_ERROR)
+	case DISK_CONTROL:
+		d.control = data
+	default:
+		log.Printf("Disk: write %04X to unmapped register %02X ignored\n", data, reg)
+	}
+}
+
+// tick counts down the pending command's latency and performs the transfer when it expires.
+func (d *Disk) tick() {
+	if d.status&STATUS_BUSY != 0 {
+		if d.wait > 0 {
+			d.wait--
+		} else {
+			if err := d.transfer(); err != nil {
+				log.Printf("Disk: %v\n", err)
+				d.status |= STATUS_ERROR
+			}
+			d.status = d.status&^STATUS_BUSY | STATUS_DONE
+		}
+	}
+	d.Pins.IRQ = d.control&CONTROL_IRQ != 0 && d.status&STATUS_DONE != 0
+}
+
+func (d *Disk) transfer() error {
+	if d.image == nil {
+		return fmt.Errorf("no image attached")
+	}
+	if int(d.buffer)+SECTOR_SIZE > ram.RAM_SIZE {
+		return fmt.Errorf("buffer %04X overruns memory", d.buffer)
+	}
+	// The CPU would not see a transfer into a device window such as the
+	// framebuffer, since the bus sends those addresses to the device.
+	if d.IsRAM != nil {
+		for address := int(d.buffer); address < int(d.buffer)+SECTOR_SIZE; address++ {
+			if !d.IsRAM(uint16(address)) {
+				return fmt.Errorf("buffer %04X overlaps the device window at %04X", d.buffer, address)
+			}
+		}
+	}
+	buffer := d.Memory[d.buffer : int(d.buffer)+SECTOR_SIZE]
+	offset := int64(d.sector) * SECTOR_SIZE
+
+	switch d.command {
+	case COMMAND_READ:
+		n, err := d.image.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		clear(buffer[n:]) // Sectors past the end of the image read as zeros
+		log.Printf("Disk: read sector %d into %04X\n", d.sector, d.buffer)
+	case COMMAND_WRITE:
+		if _, err := d.image.WriteAt(buffer, offset); err != nil {
+			return err
+		}
+		log.Printf("Disk: wrote sector %d from %04X\n", d.sector, d.buffer)
+	default:
+		return fmt.Errorf("unknown command %04X", d.command)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package framebuffer
+
+import (
+	"code/g16/pins"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+)
+
+const WIDTH = 256
+const HEIGHT = 192
+const BITS_PER_PIXEL = 4 // Two pixels per byte, left pixel in the low nibble
+const PALETTE_SIZE = 1 << BITS_PER_PIXEL
+
+const FRAMEBUFFER_ADDRESS = 0x8000
+const FRAMEBUFFER_SIZE = WIDTH * HEIGHT * BITS_PER_PIXEL / 8 // 0x6000 bytes, ends at 0xDFFF
+
+const REGISTER_ADDRESS = 0xE100
+const REGISTER_SIZE = 0x26
+
+const ( // Register offsets from REGISTER_ADDRESS, one word each
+	FB_PALETTE = 0x00 // 16 RGB565 entries, 0x00-0x1E
+	FB_CONTROL = 0x20
+	FB_STATUS  = 0x22 // Write 1s to clear sticky bits
+	FB_FRAME   = 0x24 // Frames completed, wraps at 16 bits
+)
+
+const (
+	CONTROL_VBLANK_IRQ uint16 = 1 << 0
+	STATUS_IN_VBLANK   uint16 = 1 << 0 // Set while the beam is in vertical blank
+	STATUS_VBLANK      uint16 = 1 << 1 // Sticky, set at the start of every vertical blank
+)
+
+const DEFAULT_CYCLES_PER_FRAME = 1000
+const VBLANK_FRACTION = 8 // The last 1/8th of each frame is vertical blank
+
+// CGA-style default palette in RGB565.
+var DefaultPalette = [PALETTE_SIZE]uint16{
+	0x0000, 0x0015, 0x0540, 0x0555, 0xA800, 0xA815, 0xAAA0, 0xAD55,
+	0x52AA, 0x52BF, 0x57EA, 0x57FF, 0xFAAA, 0xFABF, 0xFFEA, 0xFFFF,
+}
+
+type Framebuffer struct {
+	Pins           *pins.Pins
+	CyclesPerFrame uint64
+	memory         [FRAMEBUFFER_SIZE]byte
+	palette        [PALETTE_SIZE]uint16
+	control        uint16
+	status         uint16
+	frame          uint16
+	cycles         uint64
+}
+
+func (fb *Framebuffer) Reset() {
+	fb.memory = [FRAMEBUFFER_SIZE]byte{}
+	fb.palette = DefaultPalette
+	fb.control = 0
+	fb.status = 0
+	fb.frame = 0
+	fb.cycles = 0
+	if fb.CyclesPerFrame == 0 {
+		fb.CyclesPerFrame = DEFAULT_CYCLES_PER_FRAME
+	}
+}
+
+func (fb *Framebuffer) ProcessCycle() {
+	fb.tick()
+
+	if !fb.Pins.Valid {
+		return
+	}
+
+	addr := fb.Pins.Address
+	if addr >= FRAMEBUFFER_ADDRESS && addr-FRAMEBUFFER_ADDRESS < FRAMEBUFFER_SIZE {
+		offset := int(addr - FRAMEBUFFER_ADDRESS)
+		if fb.Pins.RW { // Read
+			fb.Pins.Data = uint16(fb.memory[offset])
+			if offset+1 < FRAMEBUFFER_SIZE {
+				fb.Pins.Data |= uint16(fb.memory[offset+1]) << 8
+			}
+		} else { // Write
+			fb.memory[offset] = byte(fb.Pins.Data)
+			if offset+1 < FRAMEBUFFER_SIZE {
+				fb.memory[offset+1] = byte(fb.Pins.Data >> 8)
+			}
+			fb.Pins.Valid = false
+		}
+		return
+	}
+
+	reg := addr - REGISTER_ADDRESS
+	if fb.Pins.RW { // Read
+		fb.Pins.Data = fb.read(reg)
+	} else { // Write
+		fb.write(reg, fb.Pins.Data)
+		fb.Pins.Valid = false
+	}
+}
+
+// tick advances the beam by one cycle and raises vblank at the start of the blanking period.
+func (fb *Framebuffer) tick() {
+	fb.cycles++
+	position := fb.cycles % fb.CyclesPerFrame
+	blankStart := fb.CyclesPerFrame - fb.CyclesPerFrame/VBLANK_FRACTION
+
+	switch {
+	case position == blankStart:
+		fb.status |= STATUS_IN_VBLANK | STATUS_VBLANK
+	case position == 0:
+		fb.status &^= STATUS_IN_VBLANK
+		fb.frame++
+	}
+	fb.Pins.IRQ = fb.control&CONTROL_VBLANK_IRQ != 0 && fb.status&STATUS_VBLANK != 0
+}
+
+func (fb *Framebuffer) read(reg uint16) uint16 {
+	switch {
+	case reg < FB_CONTROL:
+		return fb.palette[reg/2]
+	case reg == FB_CONTROL:
+		return fb.control
+	case reg == FB_STATUS:
+		return fb.status
+	case reg == FB_FRAME:
+		return fb.frame
+	default:
+		log.Printf("Framebuffer: read from unmapped register %02X\n", reg)
+		return 0
+	}
+}
+
+func (fb *Framebuffer) write(reg uint16, data uint16) {
+	switch {
+	case reg < FB_CONTROL:
+		fb.palette[reg/2] = data
+	case reg == FB_CONTROL:
+		fb.control = data
+	case reg == FB_STATUS:
+		fb.status &^= data & STATUS_VBLANK
+	default:
+		log.Printf("Framebuffer: write %04X to read-only register %02X ignored\n", data, reg)
+	}
+}
+
+// Image renders the current contents of the framebuffer through the palette.
+func (fb *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
+	for y := range HEIGHT {
+		for x := range WIDTH {
+			b := fb.memory[(y*WIDTH+x)/2]
+			index := b & 0x0F
+			if x%2 == 1 {
+				index = b >> 4
+			}
+			img.SetRGBA(x, y, RGB565(fb.palette[index]))
+		}
+	}
+	return img
+}
+
+// RGB565 expands a 5-6-5 palette entry to 8 bits per channel.
+func RGB565(c uint16) color.RGBA {
+	r := uint8(c >> 11 & 0x1F)
+	g := uint8(c >> 5 & 0x3F)
+	b := uint8(c & 0x1F)
+	return color.RGBA{R: r<<3 | r>>2, G: g<<2 | g>>4, B: b<<3 | b>>2, A: 0xFF}
+}
+
+func (fb *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, fb.Image())
+}
+
+func (fb *Framebuffer) SavePNG(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := fb.WritePNG(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,184 @@
+package gpio
+
+import (
+	"cmp"
+	"code/g16/pins"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const GPIO_ADDRESS = 0xED00
+const GPIO_SIZE = 0x0C
+const PIN_COUNT = 16
+
+const ( // Register offsets from GPIO_ADDRESS, one word each, bit n is pin n
+	GPIO_DIRECTION = 0x00 // 1 = output
+	GPIO_OUTPUT    = 0x02
+	GPIO_INPUT     = 0x04 // Level on every pin, outputs read back what they drive
+	GPIO_RISE      = 0x06 // Interrupt on rising edges of these input pins
+	GPIO_FALL      = 0x08 // Interrupt on falling edges of these input pins
+	GPIO_EDGES     = 0x0A // Edges seen, write 1s to clear
+)
+
+// Event sets a switch at a given device cycle, for scripted tests.
+type Event struct {
+	Cycle uint64
+	Pin   int
+	Level bool
+}
+
+type GPIO struct {
+	Pins      *pins.Pins
+	direction uint16
+	output    uint16
+	switches  uint16 // Levels the host drives onto input pins
+	level     uint16 // Input levels seen last cycle
+	rise      uint16
+	fall      uint16
+	edges     uint16
+	cycles    uint64
+	script    []Event
+}
+
+// SetSwitch drives an input pin from the host side.
+func (g *GPIO) SetSwitch(pin int, level bool) {
+	if level {
+		g.switches |= 1 << pin
+	} else {
+		g.switches &^= 1 << pin
+	}
+}
+
+// Schedule queues switch changes to happen at the given cycles.
+func (g *GPIO) Schedule(events ...Event) {
+	g.script = append(g.script, events...)
+	slices.SortStableFunc(g.script, func(a, b Event) int {
+		return cmp.Compare(a.Cycle, b.Cycle)
+	})
+}
+
+// LEDs returns the levels of the output pins.
+func (g *GPIO) LEDs() uint16 {
+	return g.output & g.direction
+}
+
+func (g *GPIO) ProcessCycle() {
+	g.cycles++
+	for len(g.script) > 0 && g.script[0].Cycle <= g.cycles {
+		event := g.script[0]
+		log.Printf("GPIO: scripted switch %d -> %t at device cycle %d\n", event.Pin, event.Level, g.cycles)
+		g.SetSwitch(event.Pin, event.Level)
+		g.script = g.script[1:]
+	}
+
+	input := g.input()
+	changed := (input ^ g.level) &^ g.direction
+	g.edges |= changed & input & g.rise
+	g.edges |= changed &^ input & g.fall
+	g.level = input
+	g.Pins.IRQ = g.edges != 0
+
+	if !g.Pins.Valid {
+		return
+	}
+
+	reg := g.Pins.Address - GPIO_ADDRESS
+	if g.Pins.RW { // Read
+		switch reg {
+		case GPIO_DIRECTION:
+			g.Pins.Data = g.direction
+		case GPIO_OUTPUT:
+			g.Pins.Data = g.output
+		case GPIO_INPUT:
+			g.Pins.Data = input
+		case GPIO_RISE:
+			g.Pins.Data = g.rise
+		case GPIO_FALL:
+			g.Pins.Data = g.fall
+		case GPIO_EDGES:
+			g.Pins.Data = g.edges
+		default:
+			log.Printf("GPIO: read from unmapped register %02X\n", reg)
+			g.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case GPIO_DIRECTION:
+			g.direction = g.Pins.Data
+		case GPIO_OUTPUT:
+			g.output = g.Pins.Data
+		case GPIO_RISE:
+			g.rise = g.Pins.Data
+		case GPIO_FALL:
+			g.fall = g.Pins.Data
+		case GPIO_EDGES:
+			g.edges &^= g.Pins.Data
+		default:
+			log.Printf("GPIO: write %04X to read-only register %02X ignored\n", g.Pins.Data, reg)
+		}
+		g.Pins.Valid = false
+	}
+}
+
+func (g *GPIO) input() uint16 {
+	return g.output&g.direction | g.switches&^g.direction
+}
+
+// Panel renders output pins as LEDs and input pins as switches, pin 0 on the right.
+func (g *GPIO) Panel() string {
+	var leds, switches strings.Builder
+	input := g.input()
+	for pin := PIN_COUNT - 1; pin >= 0; pin-- {
+		bit := uint16(1) << pin
+		switch {
+		case g.direction&bit == 0:
+			leds.WriteRune(' ')
+			switches.WriteRune(pick(input&bit != 0, '▲', '▽'))
+		default:
+			leds.WriteRune(pick(input&bit != 0, '●', '○'))
+			switches.WriteRune(' ')
+		}
+	}
+	return fmt.Sprintf("LEDs     [%s]\nSwitches [%s]\n", leds.String(), switches.String())
+}
+
+func pick(on bool, yes rune, no rune) rune {
+	if on {
+		return yes
+	}
+	return no
+}
+
+// ParseScript reads switch events written as cycle:pin=level, separated by
+// commas, e.g. "10000:3=1,12000:3=0".
+func ParseScript(script string) ([]Event, error) {
+	var events []Event
+	for item := range strings.SplitSeq(script, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		cycle, rest, ok := strings.Cut(item, ":")
+		pin, level, ok2 := strings.Cut(rest, "=")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("malformed GPIO event %q, expected cycle:pin=level", item)
+		}
+		c, err := strconv.ParseUint(cycle, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad cycle in GPIO event %q: %w", item, err)
+		}
+		p, err := strconv.Atoi(pin)
+		if err != nil || p < 0 || p >= PIN_COUNT {
+			return nil, fmt.Errorf("bad pin in GPIO event %q", item)
+		}
+		l, err := strconv.ParseBool(level)
+		if err != nil {
+			return nil, fmt.Errorf("bad level in GPIO event %q: %w", item, err)
+		}
+		events = append(events, Event{Cycle: c, Pin: p, Level: l})
+	}
+	return events, nil
+}
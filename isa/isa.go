@@ -55,4 +55,5 @@ const ( // 5-bit opcode
 	POP
 
 	NOP
+	RETI // Return from interrupt: pop RPC then RF
 )
@@ -0,0 +1,447 @@
+package lcd
+
+import (
+	"code/g16/pins"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const LCD_ADDRESS = 0xEB00
+const LCD_SIZE = 0x04
+
+const ( // Register offsets from LCD_ADDRESS, one word each, data in the low byte
+	LCD_COMMAND = 0x00 // Write: instruction. Read: busy flag (bit 7) and address counter
+	LCD_DATA    = 0x02 // Read/write DDRAM or CGRAM at the address counter
+)
+
+const COLUMNS = 16
+const LINES = 2
+const LINE_LENGTH = 40 // DDRAM bytes per line in two-line mode
+const LINE2_ADDRESS = 0x40
+const DDRAM_SIZE = 0x80
+const CGRAM_SIZE = 0x40
+
+const ( // Instructions, identified by their highest set bit
+	CMD_CLEAR       = 0x01
+	CMD_HOME        = 0x02
+	CMD_ENTRY_MODE  = 0x04 // | ENTRY_INCREMENT | ENTRY_SHIFT
+	CMD_DISPLAY     = 0x08 // | DISPLAY_ON | DISPLAY_CURSOR | DISPLAY_BLINK
+	CMD_SHIFT       = 0x10 // | SHIFT_DISPLAY | SHIFT_RIGHT
+	CMD_FUNCTION    = 0x20 // | FUNCTION_8BIT | FUNCTION_2LINE | FUNCTION_5X10
+	CMD_CGRAM       = 0x40 // | address
+	CMD_DDRAM       = 0x80 // | address
+	ENTRY_SHIFT     = 0x01
+	ENTRY_INCREMENT = 0x02
+	DISPLAY_BLINK   = 0x01
+	DISPLAY_CURSOR  = 0x02
+	DISPLAY_ON      = 0x04
+	SHIFT_RIGHT     = 0x04
+	SHIFT_DISPLAY   = 0x08
+	FUNCTION_5X10   = 0x04
+	FUNCTION_2LINE  = 0x08
+	FUNCTION_8BIT   = 0x10
+	BUSY_FLAG       = 0x80
+	CLEAR_LATENCY   = 40 // Cycles that clear and home keep the controller busy
+	COMMAND_LATENCY = 1  // Cycles every other access keeps the controller busy
+)
+
+const CUSTOM_CHARACTER = '▒'      // How CGRAM characters appear in the text rendering
+const BLINK_CHARACTER = '█'       // How the blinking cursor block appears in the text rendering
+const CURSOR_UNDERLINE = '\u0332' // Combining low line drawn under the character at the cursor
+
+const ( // Snapshot geometry
+	CHAR_WIDTH  = 5 // Dots per character cell
+	CHAR_HEIGHT = 8
+	DOT_SCALE   = 4 // Image pixels per dot
+	CELL_GAP    = 1 // Dots between cells and around the edge
+)
+
+var ( // Snapshot colours
+	BACKLIGHT = color.RGBA{R: 0x9C, G: 0xC4, B: 0x3C, A: 0xFF}
+	DOT_OFF   = color.RGBA{R: 0x8C, G: 0xB2, B: 0x34, A: 0xFF}
+	DOT_ON    = color.RGBA{R: 0x1E, G: 0x2A, B: 0x10, A: 0xFF}
+)
+
+type LCD struct {
+	Pins     *pins.Pins
+	ddram    [DDRAM_SIZE]byte
+	cgram    [CGRAM_SIZE]byte
+	ac       uint8 // Address counter
+	inCGRAM  bool  // Whether the address counter points into CGRAM
+	entry    uint8
+	display  uint8
+	function uint8
+	shift    int // DDRAM column shown at the left edge of the display
+	busy     uint64
+	nibble   uint8 // First half of a 4-bit transfer
+	pending  bool  // A 4-bit transfer is half done
+}
+
+func (lcd *LCD) Reset() {
+	for i := range lcd.ddram {
+		lcd.ddram[i] = ' '
+	}
+	lcd.cgram = [CGRAM_SIZE]byte{}
+	lcd.ac = 0
+	lcd.inCGRAM = false
+	lcd.entry = ENTRY_INCREMENT
+	lcd.display = 0
+	lcd.function = FUNCTION_8BIT // Power-on state is 8-bit, one line
+	lcd.shift = 0
+	lcd.busy = 0
+	lcd.pending = false
+}
+
+func (lcd *LCD) ProcessCycle() {
+	if lcd.busy > 0 {
+		lcd.busy--
+	}
+
+	if !lcd.Pins.Valid {
+		return
+	}
+
+	reg := lcd.Pins.Address - LCD_ADDRESS
+	if reg != LCD_COMMAND && reg != LCD_DATA {
+		log.Printf("LCD: access to unmapped register %02X ignored\n", reg)
+		if lcd.Pins.RW {
+			lcd.Pins.Data = 0
+		} else {
+			lcd.Pins.Valid = false
+		}
+		return
+	}
+
+	if lcd.Pins.RW { // Read
+		var value uint8
+		if reg == LCD_COMMAND {
+			value = lcd.ac
+			if lcd.busy > 0 {
+				value |= BUSY_FLAG
+			}
+		} else {
+			value = lcd.readData()
+		}
+		lcd.Pins.Data = uint16(lcd.transferOut(value))
+		return
+	}
+
+	// Write
+	lcd.Pins.Valid = false
+	value, complete := lcd.transferIn(uint8(lcd.Pins.Data))
+	if !complete {
+		return
+	}
+	if lcd.busy > 0 {
+		log.Printf("LCD: write %02X while busy ignored\n", value)
+		return
+	}
+	lcd.busy = COMMAND_LATENCY
+	if reg == LCD_COMMAND {
+		lcd.instruction(value)
+	} else {
+		lcd.writeData(value)
+	}
+}
+
+// transferIn assembles a byte from the bus. In 4-bit mode each byte arrives as
+// two writes, high nibble first, on data bits 7-4.
+func (lcd *LCD) transferIn(data uint8) (uint8, bool) {
+	if lcd.function&FUNCTION_8BIT != 0 {
+		return data, true
+	}
+	if !lcd.pending {
+		lcd.nibble = data & 0xF0
+		lcd.pending = true
+		return 0, false
+	}
+	lcd.pending = false
+	return lcd.nibble | data>>4, true
+}
+
+// transferOut splits a byte for the bus in 4-bit mode, high nibble first.
+// Reads of DATA only advance the address counter on the second nibble, so the
+// same value is returned twice.
+func (lcd *LCD) transferOut(value uint8) uint8 {
+	if lcd.function&FUNCTION_8BIT != 0 {
+		return value
+	}
+	if !lcd.pending {
+		lcd.pending = true
+		return value & 0xF0
+	}
+	lcd.pending = false
+	return value << 4
+}
+
+func (lcd *LCD) instruction(cmd uint8) {
+	switch {
+	case cmd&CMD_DDRAM != 0:
+		lcd.ac = cmd &^ CMD_DDRAM
+		lcd.inCGRAM = false
+	case cmd&CMD_CGRAM != 0:
+		lcd.ac = cmd &^ CMD_CGRAM
+		lcd.inCGRAM = true
+	case cmd&CMD_FUNCTION != 0:
+		lcd.function = cmd
+		lcd.pending = false
+	case cmd&CMD_SHIFT != 0:
+		step := -1
+		if cmd&SHIFT_RIGHT != 0 {
+			step = 1
+		}
+		if cmd&SHIFT_DISPLAY != 0 {
+			lcd.shift -= step // Shifting the display right moves the window left
+		} else {
+			lcd.advance(step)
+		}
+	case cmd&CMD_DISPLAY != 0:
+		lcd.display = cmd
+	case cmd&CMD_ENTRY_MODE != 0:
+		lcd.entry = cmd
+	case cmd&CMD_HOME != 0:
+		lcd.ac = 0
+		lcd.inCGRAM = false
+		lcd.shift = 0
+		lcd.busy = CLEAR_LATENCY
+	case cmd&CMD_CLEAR != 0:
+		for i := range lcd.ddram {
+			lcd.ddram[i] = ' '
+		}
+		lcd.ac = 0
+		lcd.inCGRAM = false
+		lcd.shift = 0
+		lcd.entry |= ENTRY_INCREMENT
+		lcd.busy = CLEAR_LATENCY
+	}
+	log.Printf("LCD: instruction %02X\n", cmd)
+}
+
+func (lcd *LCD) readData() uint8 {
+	var value uint8
+	if lcd.inCGRAM {
+		value = lcd.cgram[lcd.ac%CGRAM_SIZE]
+	} else {
+		value = lcd.ddram[lcd.ac%DDRAM_SIZE]
+	}
+	if lcd.function&FUNCTION_8BIT != 0 || lcd.pending {
+		lcd.step()
+	}
+	return value
+}
+
+func (lcd *LCD) writeData(value uint8) {
+	if lcd.inCGRAM {
+		lcd.cgram[lcd.ac%CGRAM_SIZE] = value & 0x1F
+		lcd.step()
+		return
+	}
+	lcd.ddram[lcd.ac%DDRAM_SIZE] = value
+	lcd.step()
+	if lcd.entry&ENTRY_SHIFT != 0 {
+		if lcd.entry&ENTRY_INCREMENT != 0 {
+			lcd.shift++
+		} else {
+			lcd.shift--
+		}
+	}
+}
+
+// step moves the address counter in the direction set by entry mode.
+func (lcd *LCD) step() {
+	if lcd.entry&ENTRY_INCREMENT != 0 {
+		lcd.advance(1)
+	} else {
+		lcd.advance(-1)
+	}
+}
+
+// advance moves the address counter, wrapping the way DDRAM is laid out.
+func (lcd *LCD) advance(step int) {
+	if lcd.inCGRAM {
+		lcd.ac = uint8(int(lcd.ac)+step) % CGRAM_SIZE
+		return
+	}
+	if lcd.function&FUNCTION_2LINE == 0 {
+		lcd.ac = uint8((int(lcd.ac) + step + 2*LINE_LENGTH) % (2 * LINE_LENGTH))
+		return
+	}
+	index := int(lcd.ac%LINE2_ADDRESS) + LINE_LENGTH*int(lcd.ac/LINE2_ADDRESS)
+	index = (index + step + 2*LINE_LENGTH) % (2 * LINE_LENGTH)
+	lcd.ac = uint8(index%LINE_LENGTH + LINE2_ADDRESS*(index/LINE_LENGTH))
+}
+
+// Line returns the character codes currently visible on a display line.
+func (lcd *LCD) Line(line int) []byte {
+	visible := make([]byte, COLUMNS)
+	if lcd.display&DISPLAY_ON == 0 {
+		for i := range visible {
+			visible[i] = ' '
+		}
+		return visible
+	}
+	lineLength := 2 * LINE_LENGTH
+	base := 0
+	if lcd.function&FUNCTION_2LINE != 0 {
+		lineLength = LINE_LENGTH
+		base = line * LINE2_ADDRESS
+	} else if line > 0 {
+		for i := range visible {
+			visible[i] = ' '
+		}
+		return visible
+	}
+	for col := range COLUMNS {
+		offset := ((col+lcd.shift)%lineLength + lineLength) % lineLength
+		visible[col] = lcd.ddram[base+offset]
+	}
+	return visible
+}
+
+// Cursor returns the display line and column the cursor is shown at, and
+// false when the cursor and blink are off or the address counter is
+// scrolled out of view.
+func (lcd *LCD) Cursor() (int, int, bool) {
+	if lcd.display&DISPLAY_ON == 0 || lcd.display&(DISPLAY_CURSOR|DISPLAY_BLINK) == 0 || lcd.inCGRAM {
+		return 0, 0, false
+	}
+	line, offset, lineLength := 0, int(lcd.ac), 2*LINE_LENGTH
+	if lcd.function&FUNCTION_2LINE != 0 {
+		line, offset, lineLength = int(lcd.ac/LINE2_ADDRESS), int(lcd.ac%LINE2_ADDRESS), LINE_LENGTH
+	}
+	col := ((offset-lcd.shift)%lineLength + lineLength) % lineLength
+	if line >= LINES || col >= COLUMNS {
+		return 0, 0, false
+	}
+	return line, col, true
+}
+
+// Glyph returns the 5x8 pattern of a custom character, one row per byte.
+func (lcd *LCD) Glyph(code uint8) [CHAR_HEIGHT]byte {
+	var glyph [CHAR_HEIGHT]byte
+	copy(glyph[:], lcd.cgram[int(code%8)*CHAR_HEIGHT:])
+	for i := range glyph {
+		glyph[i] &= 1<<CHAR_WIDTH - 1
+	}
+	return glyph
+}
+
+// pattern returns the rows of the character with the given code, bit 4
+// being the leftmost dot. Codes with no pattern in the character ROM show
+// as a full block.
+func (lcd *LCD) pattern(code uint8) [CHAR_HEIGHT]byte {
+	var rows [CHAR_HEIGHT]byte
+	switch {
+	case code < 0x10:
+		return lcd.Glyph(code)
+	case code >= 0x20 && code <= 0x7E:
+		for x, column := range characterROM[code-0x20] {
+			for y := range CHAR_HEIGHT {
+				if column&(1<<y) != 0 {
+					rows[y] |= 1 << (CHAR_WIDTH - 1 - x)
+				}
+			}
+		}
+	default:
+		for y := range CHAR_HEIGHT - 1 {
+			rows[y] = 1<<CHAR_WIDTH - 1
+		}
+	}
+	return rows
+}
+
+// Image renders the display dot by dot, custom characters included. The
+// cursor is drawn as an underline on the bottom row of its cell, and a
+// blinking cursor as a solid block, the phase in which it is lit.
+func (lcd *LCD) Image() *image.RGBA {
+	width := (COLUMNS*(CHAR_WIDTH+CELL_GAP) + CELL_GAP) * DOT_SCALE
+	height := (LINES*(CHAR_HEIGHT+CELL_GAP) + CELL_GAP) * DOT_SCALE
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{BACKLIGHT}, image.Point{}, draw.Src)
+	cursorLine, cursorCol, cursor := lcd.Cursor()
+	for line := range LINES {
+		for col, code := range lcd.Line(line) {
+			rows := lcd.pattern(code)
+			if cursor && line == cursorLine && col == cursorCol {
+				if lcd.display&DISPLAY_CURSOR != 0 {
+					rows[CHAR_HEIGHT-1] = 1<<CHAR_WIDTH - 1
+				}
+				if lcd.display&DISPLAY_BLINK != 0 {
+					for y := range rows {
+						rows[y] = 1<<CHAR_WIDTH - 1
+					}
+				}
+			}
+			for y, row := range rows {
+				for x := range CHAR_WIDTH {
+					dot := DOT_OFF
+					if row&(1<<(CHAR_WIDTH-1-x)) != 0 {
+						dot = DOT_ON
+					}
+					left := (CELL_GAP + col*(CHAR_WIDTH+CELL_GAP) + x) * DOT_SCALE
+					top := (CELL_GAP + line*(CHAR_HEIGHT+CELL_GAP) + y) * DOT_SCALE
+					// Leave a hairline between dots, as on the glass.
+					for dy := range DOT_SCALE - 1 {
+						for dx := range DOT_SCALE - 1 {
+							img.SetRGBA(left+dx, top+dy, dot)
+						}
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+func (lcd *LCD) WritePNG(w io.Writer) error {
+	return png.Encode(w, lcd.Image())
+}
+
+func (lcd *LCD) SavePNG(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lcd.WritePNG(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Text renders the display as a boxed block of text, marking the cursor
+// the same way Image does.
+func (lcd *LCD) Text() string {
+	var sb strings.Builder
+	border := "+" + strings.Repeat("-", COLUMNS) + "+\n"
+	sb.WriteString(border)
+	cursorLine, cursorCol, cursor := lcd.Cursor()
+	for line := range LINES {
+		sb.WriteString("|")
+		for col, code := range lcd.Line(line) {
+			atCursor := cursor && line == cursorLine && col == cursorCol
+			switch {
+			case atCursor && lcd.display&DISPLAY_BLINK != 0:
+				sb.WriteRune(BLINK_CHARACTER)
+			case code < 0x10:
+				sb.WriteRune(CUSTOM_CHARACTER)
+			case code < 0x20 || code > 0x7E:
+				sb.WriteRune('?')
+			default:
+				sb.WriteByte(code)
+			}
+			if atCursor && lcd.display&DISPLAY_BLINK == 0 {
+				sb.WriteRune(CURSOR_UNDERLINE)
+			}
+		}
+		sb.WriteString("|\n")
+	}
+	sb.WriteString(border)
+	return sb.String()
+}
@@ -4,29 +4,38 @@ import (
 	"code/g16/assembler"
 	"code/g16/bus"
 	"code/g16/console"
+	"code/g16/coproc"
 	"code/g16/cpu"
-	. "code/g16/isa"
+	"code/g16/disk"
+	"code/g16/framebuffer"
+	"code/g16/gpio"
+	"code/g16/lcd"
+	"code/g16/nic"
+	"code/g16/perf"
+	"code/g16/pic"
 	"code/g16/pins"
 	"code/g16/ram"
+	"code/g16/rng"
+	"code/g16/rtc"
+	"code/g16/semihost"
+	"code/g16/serial"
+	"code/g16/sound"
+	"code/g16/video"
+	"code/g16/watchdog"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"strings"
 	"time"
 )
 
-func main() {
-
-	file, err := os.Create("debug.log")
-	if err != nil {
-		log.Fatalf("failed to create log file: %v", err)
-	}
-	defer file.Close()
-
-	log.SetOutput(file)
-
-	source := `
+// helloWorld is the built-in program, run when -program is not given.
+const helloWorld = `
 	mov $r1, =data ; 00: set r1 to address of data (PC:00 + OFFSET:18)
-	mov $r2, #d13  ; 02: set r2 to length of data
+	mov $r2, #LEN  ; 02: set r2 to length of data
 	mov $r3, =loop ; 04: set r3 to address of loop (PC:04 + OFFSET:02)
 	loop:          ; 06 (not an instruction)
 	mov @r0, @r1   ; 06 copy character to stdout @0x0000
@@ -37,95 +46,270 @@ func main() {
 	halt           ; 16 halt
 	data:          ; 18 (not an instruction)
 	#'Hello World!\n'
+	end:           ; 44 (not an instruction)
+	.equ LEN, (end - data) / 2 ; one word per character
 	`
-	log.Println("Source:")
-	log.Println(source)
 
-	tokens := assembler.Tokenize(source)
+// Devices are clocked on every other clock edge, while the CPU counts
+// every edge as a cycle. Cycle counts on the command line are CPU cycles,
+// the unit of the halt message and the perf counter.
+const CPU_CYCLES_PER_DEVICE_CYCLE = 2
+
+// deviceCycles converts CPU cycles to the device cycles devices count,
+// rounding up.
+func deviceCycles(cycles uint64) uint64 {
+	return (cycles + CPU_CYCLES_PER_DEVICE_CYCLE - 1) / CPU_CYCLES_PER_DEVICE_CYCLE
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run sets up and clocks the machine until it halts, returning the exit
+// status. Returning rather than exiting lets the deferred Close calls
+// flush every attached image first.
+func run() int {
+	rtcMode := flag.String("rtc", "virtual", "real-time clock source: virtual (derived from cycle count) or host (wall clock)")
+	framePNG := flag.String("png", "", "write the final framebuffer contents to this PNG file on halt")
+	videoPNG := flag.String("video-png", "", "write the final tile/sprite video frame to this PNG file on halt")
+	wavPath := flag.String("wav", "", "write the sound generator output to this WAV file on halt")
+	diskImage := flag.String("disk", "", "attach this existing host file as the block storage image")
+	diskLatency := flag.Uint64("disk-latency", disk.DEFAULT_LATENCY*CPU_CYCLES_PER_DEVICE_CYCLE, "CPU cycles a disk transfer takes to complete")
+	seed := flag.Int64("seed", -1, "seed the random number device for reproducible runs; negative uses host entropy")
+	watchdogTimeout := flag.Uint64("watchdog-timeout", watchdog.DEFAULT_TIMEOUT*CPU_CYCLES_PER_DEVICE_CYCLE, "CPU cycles the watchdog waits for a kick once software enables it")
+	coprocLatency := flag.Uint64("coproc-latency", coproc.DEFAULT_LATENCY*CPU_CYCLES_PER_DEVICE_CYCLE, "CPU cycles a math coprocessor operation takes to complete")
+	showLCD := flag.Bool("lcd", false, "print the character LCD to the terminal whenever its contents change")
+	lcdPNG := flag.String("lcd-png", "", "write the final character LCD display to this PNG file on halt")
+	eepromImage := flag.String("eeprom", "", "attach an I2C EEPROM backed by this host file to the serial controller")
+	flashImage := flag.String("flash", "", "attach an SPI flash chip backed by this host file to chip select 0")
+	serialCreate := flag.Bool("serial-create", false, "create missing -eeprom and -flash image files as blank, erased chips")
+	showGPIO := flag.Bool("gpio", false, "print the GPIO LED and switch panel to the terminal whenever it changes")
+	gpioScript := flag.String("gpio-script", "", "switch changes as cycle:pin=level, comma separated, with cycle in CPU cycles, e.g. 10000:3=1,12000:3=0")
+	nicNetwork := flag.String("nic-network", "udp", "socket type the network interface bridges to: udp or unixgram")
+	nicListen := flag.String("nic-listen", "", "local socket address the network interface receives on, e.g. 127.0.0.1:9000")
+	nicPeer := flag.String("nic-peer", "", "local socket address the network interface sends to and accepts frames from, e.g. 127.0.0.1:9001; required to use the network interface")
+	semihostRoot := flag.String("semihost-root", ".", "directory the guest's semihosting opens are confined to; paths that escape it fail")
+	programFile := flag.String("program", "", "assemble and run this source file instead of the built-in hello world")
+	includePath := flag.String("include", "", "directories searched by .include and .incbin, comma separated")
+	diagnostics := flag.String("diagnostics", "text", "how assembler errors are reported: text (with source lines) or json (on stdout, for editors)")
+	flag.Parse()
 
-	log.Println("Tokens:")
-	for _, t := range tokens {
-		log.Printf("%s: %s\n", t.Type, t.Value)
+	rtcClock := rtc.VirtualTime
+	switch *rtcMode {
+	case "virtual":
+	case "host":
+		rtcClock = rtc.HostTime
+	default:
+		log.Fatalf("unknown -rtc mode %q, expected virtual or host", *rtcMode)
+	}
+	if deviceCycles(*watchdogTimeout) > 0xFFFF {
+		log.Fatalf("-watchdog-timeout %d is too large, the maximum is %d", *watchdogTimeout, 0xFFFF*CPU_CYCLES_PER_DEVICE_CYCLE)
+	}
+	if *seed > math.MaxUint32 {
+		log.Fatalf("-seed %d is too large, the maximum is %d", *seed, uint32(math.MaxUint32))
+	}
+	if *diagnostics != "text" && *diagnostics != "json" {
+		log.Fatalf("unknown -diagnostics format %q, expected text or json", *diagnostics)
+	}
+	gpioEvents, err := gpio.ParseScript(*gpioScript)
+	if err != nil {
+		log.Fatalf("invalid -gpio-script: %v", err)
+	}
+	for i := range gpioEvents {
+		gpioEvents[i].Cycle = deviceCycles(gpioEvents[i].Cycle)
 	}
 
-	parser := assembler.NewParser(tokens)
-	instructions, data, err := parser.Parse()
+	file, err := os.Create("debug.log")
 	if err != nil {
-		fmt.Printf("Error while parsing: %e", err)
-	}
-
-	log.Println("Instructions:")
-	for _, i := range instructions {
-		log.Printf("@%d: opcode:%s, operands%v\n", i.Address, i.Opcode, i.Operands)
-	}
-
-	log.Println("Data:")
-	for _, i := range data {
-		log.Printf("@%d: data:%s, label:%s\n", i.Address, i.Data, i.Label)
-	}
-
-	intermediate := []uint16{
-		MOVIO, cpu.R1, 18, // 00: set r1 to address of data (PC:00 + OFFSET:18)
-		MOVI, cpu.R2, 13, // 02: set r2 to length of data
-		MOVIO, cpu.R3, 2, // 04: set r3 to address of loop (PC:04 + OFFSET:02)
-		//loop: 06: (not an instruction)
-		MOV, II, cpu.R0, cpu.R1, // 06: copy character to stdout @0x0000
-		INC, cpu.R1, // 08: advance r1 to address of next character
-		INC, cpu.R1, // 10: +2 for next word
-		DEC, cpu.R2, // 12: count down
-		JNZ, cpu.R3, cpu.R2, // 14: goto loop
-		HALT, // 16: halt
-		//data: 18: (not an instruction)
-		//#aHello_World!
-		uint16('H'), 0, uint16('e'), 0, uint16('l'), 0, uint16('l'), 0, uint16('o'), 0, uint16(' '), 0,
-		uint16('W'), 0, uint16('o'), 0, uint16('r'), 0, uint16('l'), 0, uint16('d'), 0, uint16('!'), 0,
-		uint16('\n'),
-	}
-	log.Println("Intermediate:")
-	log.Println(intermediate)
-
-	op_off := 3
-	rx_off := 4
-
-	program := []byte{ // Little-endian
-		18, byte(MOVIO<<op_off) | byte(cpu.R1),
-		13, byte(MOVI<<op_off) | byte(cpu.R2),
-		2, byte(MOVIO<<op_off) | byte(cpu.R3),
-		byte(cpu.R0<<rx_off) | byte(cpu.R1), byte(MOV<<op_off) | byte(II),
-		byte(cpu.R1 << rx_off), byte(INC << op_off),
-		byte(cpu.R1 << rx_off), byte(INC << op_off),
-		byte(cpu.R2 << rx_off), byte(DEC << op_off),
-		byte(cpu.R3<<rx_off) | byte(cpu.R2), byte(JNZ << op_off),
-		0, byte(HALT << op_off),
-		byte('H'), 0, byte('e'), 0, byte('l'), 0, byte('l'), 0, byte('o'), 0, byte(' '), 0,
-		byte('W'), 0, byte('o'), 0, byte('r'), 0, byte('l'), 0, byte('d'), 0, byte('!'), 0,
-		byte('\n'), 0,
+		log.Fatalf("failed to create log file: %v", err)
+	}
+	defer file.Close()
+
+	log.SetOutput(file)
+
+	asm := assembler.Assembler{}
+	if *includePath != "" {
+		asm.IncludePaths = strings.Split(*includePath, ",")
+	}
+	var program *assembler.Program
+	if *programFile != "" {
+		log.Printf("Source: %s\n", *programFile)
+		program, err = asm.AssembleFile(*programFile)
+	} else {
+		log.Println("Source:")
+		log.Println(helloWorld)
+		program, err = asm.Assemble("", helloWorld)
+	}
+	if err != nil {
+		var errs assembler.ErrorList
+		switch {
+		case !errors.As(err, &errs):
+			fmt.Fprintf(os.Stderr, "Error while assembling: %v\n", err)
+		case *diagnostics == "json":
+			errs.WriteJSON(os.Stdout)
+		default:
+			errs.Print(os.Stderr)
+		}
+		return 1
 	}
 	log.Println("Program:")
-	log.Printf("%04X\n", program)
+	for _, segment := range program.Segments {
+		log.Printf("%s @%04X: %04X\n", segment.Name, segment.Address, segment.Bytes)
+	}
+
+	var i2cDevices []serial.I2CDevice
+	var spiDevices []serial.SPIDevice
+	if *eepromImage != "" {
+		eeprom, err := serial.OpenEEPROM(*eepromImage, serial.EEPROM_SIZE, serial.EEPROM_I2C_ADDRESS, *serialCreate)
+		if err != nil {
+			log.Fatalf("failed to open EEPROM image: %v", err)
+		}
+		defer eeprom.Close()
+		i2cDevices = append(i2cDevices, eeprom)
+	}
+	if *flashImage != "" {
+		flash, err := serial.OpenFlash(*flashImage, serial.FLASH_SIZE, *serialCreate)
+		if err != nil {
+			log.Fatalf("failed to open flash image: %v", err)
+		}
+		defer flash.Close()
+		spiDevices = append(spiDevices, flash)
+	}
 
 	bus := bus.Bus{}
 	cpu := cpu.CPU{}
 	ram := ram.RAM{}
 	console := console.Console{}
+	rtc := rtc.RTC{Mode: rtcClock}
+	fb := framebuffer.Framebuffer{}
+	video := video.Video{}
+	sound := sound.Sound{}
+	disk := disk.Disk{Latency: deviceCycles(*diskLatency)}
+	rng := rng.RNG{}
+	pic := pic.PIC{}
+	semihost := semihost.Semihost{Args: flag.Args()}
+	perf := perf.Perf{Source: cpu.Counters}
+	watchdog := watchdog.Watchdog{ResetCPU: cpu.ResetFrom, Timeout: uint16(deviceCycles(*watchdogTimeout))}
+	coproc := coproc.Coproc{Latency: deviceCycles(*coprocLatency)}
+	lcd := lcd.LCD{}
+	serial := serial.Serial{BitCycles: serial.DEFAULT_BIT_CYCLES}
+	gpio := gpio.GPIO{}
+	nic := nic.NIC{}
 
 	cpu_pins := &pins.Pins{}
 	ram_pins := &pins.Pins{}
 	console_pins := &pins.Pins{}
+	rtc_pins := &pins.Pins{}
+	fb_pins := &pins.Pins{}
+	video_pins := &pins.Pins{}
+	sound_pins := &pins.Pins{}
+	disk_pins := &pins.Pins{}
+	rng_pins := &pins.Pins{}
+	pic_pins := &pins.Pins{}
+	host_pins := &pins.Pins{}
+	perf_pins := &pins.Pins{}
+	wdt_pins := &pins.Pins{}
+	math_pins := &pins.Pins{}
+	lcd_pins := &pins.Pins{}
+	serial_pins := &pins.Pins{}
+	gpio_pins := &pins.Pins{}
+	nic_pins := &pins.Pins{}
 
 	cpu.Reset()
 	cpu.Pins = cpu_pins
-	ram.Init(program)
+	for _, segment := range program.Segments {
+		ram.Load(segment.Address, segment.Bytes)
+	}
 	ram.Pins = ram_pins
 	console.Pins = console_pins
+	rtc.Pins = rtc_pins
+	fb.Reset()
+	fb.Pins = fb_pins
+	video.Reset()
+	video.Pins = video_pins
+	sound.Reset()
+	sound.Pins = sound_pins
+	disk.Pins = disk_pins
+	disk.Memory = ram.Memory()
+	disk.IsRAM = bus.IsRAM
+	if *diskImage != "" {
+		if err := disk.Open(*diskImage); err != nil {
+			log.Fatalf("failed to open disk image: %v", err)
+		}
+		defer disk.Close()
+	}
+	rng.Pins = rng_pins
+	if *seed >= 0 {
+		rng.Seed(uint32(*seed))
+	}
+	pic.Pins = pic_pins
+	pic.Reset()
+	semihost.Pins = host_pins
+	semihost.Memory = ram.Memory()
+	semihost.IsRAM = bus.IsRAM
+	root, err := os.OpenRoot(*semihostRoot)
+	if err != nil {
+		log.Fatalf("failed to open -semihost-root: %v", err)
+	}
+	defer root.Close()
+	semihost.Root = root
+	semihost.Reset()
+	defer semihost.Close()
+	perf.Pins = perf_pins
+	watchdog.Pins = wdt_pins
+	watchdog.Reset()
+	coproc.Pins = math_pins
+	lcd.Pins = lcd_pins
+	lcd.Reset()
+	serial.Pins = serial_pins
+	for _, device := range i2cDevices {
+		serial.AttachI2C(device)
+	}
+	for cs, device := range spiDevices {
+		if err := serial.AttachSPI(cs, device); err != nil {
+			log.Fatalf("failed to attach SPI device: %v", err)
+		}
+	}
+	gpio.Pins = gpio_pins
+	gpio.Schedule(gpioEvents...)
+	nic.Pins = nic_pins
+	nic.Memory = ram.Memory()
+	nic.IsRAM = bus.IsRAM
+	if *nicListen != "" || *nicPeer != "" {
+		if err := nic.Open(*nicNetwork, *nicListen, *nicPeer); err != nil {
+			log.Fatalf("failed to open network interface: %v", err)
+		}
+		defer nic.Close()
+	}
 
 	bus.CPU_Pins = cpu_pins
 	bus.RAM_Pins = ram_pins
 	bus.CONSOLE_Pins = console_pins
+	bus.RTC_Pins = rtc_pins
+	bus.FB_Pins = fb_pins
+	bus.VIDEO_Pins = video_pins
+	bus.SOUND_Pins = sound_pins
+	bus.DISK_Pins = disk_pins
+	bus.RNG_Pins = rng_pins
+	bus.PIC_Pins = pic_pins
+	bus.PIC = &pic
+	bus.HOST_Pins = host_pins
+	bus.PERF_Pins = perf_pins
+	bus.WDT_Pins = wdt_pins
+	bus.RegisterNMI(wdt_pins)
+	bus.MATH_Pins = math_pins
+	bus.LCD_Pins = lcd_pins
+	bus.SERIAL_Pins = serial_pins
+	bus.GPIO_Pins = gpio_pins
+	bus.NIC_Pins = nic_pins
 
 	var hertz uint16 = 100
+	rtc.CyclesPerSecond = uint64(hertz) / CPU_CYCLES_PER_DEVICE_CYCLE
+	sound.CyclesPerSecond = uint64(hertz) / CPU_CYCLES_PER_DEVICE_CYCLE
 	clk := false
-	for !cpu.Halt {
+	lcdText := ""
+	gpioPanel := ""
+	for !cpu.Halt && !semihost.Exited {
 		// TODO: add console output
 		time.Sleep(time.Second / time.Duration(hertz))
 		clk = !clk
@@ -135,10 +319,63 @@ func main() {
 		} else {
 			ram.ProcessCycle()
 			console.ProcessCycle()
+			rtc.ProcessCycle()
+			fb.ProcessCycle()
+			video.ProcessCycle()
+			sound.ProcessCycle()
+			disk.ProcessCycle()
+			rng.ProcessCycle()
+			pic.ProcessCycle()
+			semihost.ProcessCycle()
+			perf.ProcessCycle()
+			watchdog.ProcessCycle()
+			coproc.ProcessCycle()
+			lcd.ProcessCycle()
+			serial.ProcessCycle()
+			gpio.ProcessCycle()
+			nic.ProcessCycle()
 			bus.ReturnCycle()
 			cpu.CompleteCycle()
 		}
+		if *showLCD {
+			if text := lcd.Text(); text != lcdText {
+				fmt.Print(text)
+				lcdText = text
+			}
+		}
+		if *showGPIO {
+			if panel := gpio.Panel(); panel != gpioPanel {
+				fmt.Print(panel)
+				gpioPanel = panel
+			}
+		}
 	}
 
 	cpu.DumpReg()
+
+	if *framePNG != "" {
+		if err := fb.SavePNG(*framePNG); err != nil {
+			log.Fatalf("failed to write framebuffer snapshot: %v", err)
+		}
+	}
+	if *videoPNG != "" {
+		if err := video.SavePNG(*videoPNG); err != nil {
+			log.Fatalf("failed to write video snapshot: %v", err)
+		}
+	}
+	if *lcdPNG != "" {
+		if err := lcd.SavePNG(*lcdPNG); err != nil {
+			log.Fatalf("failed to write LCD snapshot: %v", err)
+		}
+	}
+	if *wavPath != "" {
+		if err := sound.SaveWAV(*wavPath); err != nil {
+			log.Fatalf("failed to write sound output: %v", err)
+		}
+	}
+
+	if semihost.Exited {
+		return semihost.ExitCode
+	}
+	return 0
 }
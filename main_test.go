@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"code/g16/assembler"
+	"code/g16/cpu"
+	. "code/g16/isa"
+	"testing"
+)
+
+// TestHelloWorldEncoding pins the assembled boot program to the bytes it
+// was hand-encoded as before the assembler existed.
+func TestHelloWorldEncoding(t *testing.T) {
+	const op_off = 3
+	const rx_off = 4
+	want := []byte{ // Little-endian
+		18, byte(MOVIO<<op_off) | byte(cpu.R1),
+		13, byte(MOVI<<op_off) | byte(cpu.R2),
+		2, byte(MOVIO<<op_off) | byte(cpu.R3),
+		byte(cpu.R0<<rx_off) | byte(cpu.R1), byte(MOV<<op_off) | byte(II),
+		byte(cpu.R1 << rx_off), byte(INC << op_off),
+		byte(cpu.R1 << rx_off), byte(INC << op_off),
+		byte(cpu.R2 << rx_off), byte(DEC << op_off),
+		byte(cpu.R3<<rx_off) | byte(cpu.R2), byte(JNZ << op_off),
+		0, byte(HALT << op_off),
+		byte('H'), 0, byte('e'), 0, byte('l'), 0, byte('l'), 0, byte('o'), 0, byte(' '), 0,
+		byte('W'), 0, byte('o'), 0, byte('r'), 0, byte('l'), 0, byte('d'), 0, byte('!'), 0,
+		byte('\n'), 0,
+	}
+
+	program, err := assembler.Assemble(helloWorld)
+	if err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	if len(program.Segments) != 1 {
+		t.Fatalf("got %d segments, want 1", len(program.Segments))
+	}
+	segment := program.Segments[0]
+	if segment.Address != cpu.PROGRAM_START {
+		t.Errorf("loads at %04X, want %04X", segment.Address, cpu.PROGRAM_START)
+	}
+	if !bytes.Equal(segment.Bytes, want) {
+		t.Errorf("assembled\n%X\nwant\n%X", segment.Bytes, want)
+	}
+}
@@ -0,0 +1,275 @@
+package nic
+
+import (
+	"code/g16/pins"
+	"code/g16/ram"
+	"fmt"
+	"log"
+	"net"
+)
+
+const NIC_ADDRESS = 0xEE00
+const NIC_SIZE = 0x10
+const MAX_FRAME = 1536
+const RX_QUEUE = 16 // Frames held while the guest is not receiving
+
+const ( // Register offsets from NIC_ADDRESS, one word each
+	NIC_TX_BUFFER = 0x00 // RAM address of the frame to send
+	NIC_TX_LENGTH = 0x02
+	NIC_RX_BUFFER = 0x04 // RAM address received frames are copied to
+	NIC_RX_SIZE   = 0x06 // Capacity of the receive buffer
+	NIC_RX_LENGTH = 0x08 // Length of the last received frame, read-only
+	NIC_COMMAND   = 0x0A
+	NIC_STATUS    = 0x0C // Write 1s to clear TX_DONE, TX_ERROR, RX_READY, RX_TRUNCATED and RX_ERROR
+	NIC_CONTROL   = 0x0E
+)
+
+const (
+	COMMAND_SEND    uint16 = 1 // Send TX_LENGTH bytes from TX_BUFFER
+	COMMAND_RECEIVE uint16 = 2 // Arm the receiver for one frame
+)
+
+const (
+	STATUS_TX_DONE      uint16 = 1 << 0
+	STATUS_TX_ERROR     uint16 = 1 << 1
+	STATUS_RX_READY     uint16 = 1 << 2
+	STATUS_RX_TRUNCATED uint16 = 1 << 3 // The frame was longer than RX_SIZE
+	STATUS_RX_ARMED     uint16 = 1 << 4
+	STATUS_RX_ERROR     uint16 = 1 << 5 // RX_BUFFER overlaps a device window; the receiver was disarmed
+)
+
+const (
+	CONTROL_TX_IRQ uint16 = 1 << 0
+	CONTROL_RX_IRQ uint16 = 1 << 1
+)
+
+type NIC struct {
+	Pins     *pins.Pins
+	Memory   *[ram.RAM_SIZE]byte       // Frames move straight between RAM and the socket
+	IsRAM    func(address uint16) bool // Reports addresses the bus routes to RAM; buffers must lie there
+	conn     net.PacketConn
+	peer     net.Addr
+	frames   chan []byte
+	txBuffer uint16
+	txLength uint16
+	rxBuffer uint16
+	rxSize   uint16
+	rxLength uint16
+	status   uint16
+	control  uint16
+}
+
+// Open bridges the NIC to a local datagram socket. network is "udp" or
+// "unixgram". A peer is required: frames are sent to it, and datagrams
+// from any other sender are dropped. UDP addresses, both listening and
+// peer, must be on the loopback interface so that nothing beyond this
+// host can reach the guest.
+func (n *NIC) Open(network string, local string, remote string) error {
+	if remote == "" {
+		return fmt.Errorf("a peer address is required")
+	}
+	var conn net.PacketConn
+	var peer net.Addr
+	var err error
+	switch network {
+	case "udp":
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr(network, remote); err != nil {
+			return err
+		}
+		if !addr.IP.IsLoopback() {
+			return fmt.Errorf("peer %s is not a loopback address", remote)
+		}
+		peer = addr
+		if local == "" {
+			local = "127.0.0.1:0" // Any free loopback port, for a NIC that only sends
+		}
+		if addr, err = net.ResolveUDPAddr(network, local); err != nil {
+			return err
+		}
+		if !addr.IP.IsLoopback() {
+			return fmt.Errorf("listen address %q is not a loopback address", local)
+		}
+		conn, err = net.ListenPacket(network, local)
+	case "unixgram":
+		if peer, err = net.ResolveUnixAddr(network, remote); err != nil {
+			return err
+		}
+		conn, err = net.ListenPacket(network, local)
+	default:
+		return fmt.Errorf("unsupported network %q, expected udp or unixgram", network)
+	}
+	if err != nil {
+		return err
+	}
+	n.Connect(conn, peer)
+	return nil
+}
+
+// Connect bridges the NIC to an already open socket, such as one a test harness created.
+func (n *NIC) Connect(conn net.PacketConn, peer net.Addr) {
+	n.conn = conn
+	n.peer = peer
+	n.frames = make(chan []byte, RX_QUEUE)
+	go n.receive()
+	log.Printf("NIC: bridged %s to %s\n", conn.LocalAddr(), peer)
+}
+
+func (n *NIC) Close() error {
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// receive queues incoming frames from the peer until the socket closes.
+func (n *NIC) receive() {
+	conn, frames, peer := n.conn, n.frames, n.peer
+	defer close(frames)
+	for {
+		buffer := make([]byte, MAX_FRAME)
+		length, from, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if from == nil || from.String() != peer.String() {
+			log.Printf("NIC: dropped %d byte frame from %v, expected %s\n", length, from, peer)
+			continue
+		}
+		select {
+		case frames <- buffer[:length]:
+		default:
+			log.Printf("NIC: receive queue full, dropped %d byte frame\n", length)
+		}
+	}
+}
+
+func (n *NIC) ProcessCycle() {
+	n.poll()
+	n.Pins.IRQ = n.control&CONTROL_TX_IRQ != 0 && n.status&(STATUS_TX_DONE|STATUS_TX_ERROR) != 0 ||
+		n.control&CONTROL_RX_IRQ != 0 && n.status&(STATUS_RX_READY|STATUS_RX_ERROR) != 0
+
+	if !n.Pins.Valid {
+		return
+	}
+
+	reg := n.Pins.Address - NIC_ADDRESS
+	if n.Pins.RW { // Read
+		switch reg {
+		case NIC_TX_BUFFER:
+			n.Pins.Data = n.txBuffer
+		case NIC_TX_LENGTH:
+			n.Pins.Data = n.txLength
+		case NIC_RX_BUFFER:
+			n.Pins.Data = n.rxBuffer
+		case NIC_RX_SIZE:
+			n.Pins.Data = n.rxSize
+		case NIC_RX_LENGTH:
+			n.Pins.Data = n.rxLength
+		case NIC_STATUS:
+			n.Pins.Data = n.status
+		case NIC_CONTROL:
+			n.Pins.Data = n.control
+		default:
+			log.Printf("NIC: read from unmapped register %02X\n", reg)
+			n.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case NIC_TX_BUFFER:
+			n.txBuffer = n.Pins.Data
+		case NIC_TX_LENGTH:
+			n.txLength = n.Pins.Data
+		case NIC_RX_BUFFER:
+			n.rxBuffer = n.Pins.Data
+		case NIC_RX_SIZE:
+			n.rxSize = n.Pins.Data
+		case NIC_COMMAND:
+			n.command(n.Pins.Data)
+		case NIC_STATUS:
+			n.status &^= n.Pins.Data &^ STATUS_RX_ARMED
+		case NIC_CONTROL:
+			n.control = n.Pins.Data
+		default:
+			log.Printf("NIC: write %04X to read-only register %02X ignored\n", n.Pins.Data, reg)
+		}
+		n.Pins.Valid = false
+	}
+}
+
+func (n *NIC) command(cmd uint16) {
+	switch cmd {
+	case COMMAND_SEND:
+		n.status &^= STATUS_TX_DONE | STATUS_TX_ERROR
+		if err := n.send(); err != nil {
+			log.Printf("NIC: send failed: %v\n", err)
+			n.status |= STATUS_TX_ERROR
+		}
+		n.status |= STATUS_TX_DONE
+	case COMMAND_RECEIVE:
+		n.status = n.status&^(STATUS_RX_READY|STATUS_RX_TRUNCATED|STATUS_RX_ERROR) | STATUS_RX_ARMED
+	default:
+		log.Printf("NIC: unknown command %d\n", cmd)
+	}
+}
+
+func (n *NIC) send() error {
+	if n.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if n.txLength > MAX_FRAME || int(n.txBuffer)+int(n.txLength) > ram.RAM_SIZE {
+		return fmt.Errorf("frame of %d bytes at %04X is out of range", n.txLength, n.txBuffer)
+	}
+	if err := n.checkBuffer(n.txBuffer, int(n.txLength)); err != nil {
+		return err
+	}
+	frame := n.Memory[n.txBuffer : int(n.txBuffer)+int(n.txLength)]
+	_, err := n.conn.WriteTo(frame, n.peer)
+	log.Printf("NIC: sent %d byte frame\n", len(frame))
+	return err
+}
+
+// checkBuffer fails if any of the length bytes from address, up to the end
+// of memory, is in a device window. The CPU would not see a frame there,
+// since the bus sends those addresses to the device.
+func (n *NIC) checkBuffer(address uint16, length int) error {
+	if n.IsRAM == nil {
+		return nil
+	}
+	for a := int(address); a < int(address)+length && a < ram.RAM_SIZE; a++ {
+		if !n.IsRAM(uint16(a)) {
+			return fmt.Errorf("buffer %04X overlaps the device window at %04X", address, a)
+		}
+	}
+	return nil
+}
+
+// poll delivers one queued frame if the guest has armed the receiver.
+func (n *NIC) poll() {
+	if n.status&STATUS_RX_ARMED == 0 || n.frames == nil {
+		return
+	}
+	if err := n.checkBuffer(n.rxBuffer, int(n.rxSize)); err != nil {
+		log.Printf("NIC: receive failed: %v\n", err)
+		n.status = n.status&^STATUS_RX_ARMED | STATUS_RX_ERROR
+		return
+	}
+	select {
+	case frame, ok := <-n.frames:
+		if !ok {
+			n.frames = nil
+			return
+		}
+		size := min(int(n.rxSize), ram.RAM_SIZE-int(n.rxBuffer))
+		copied := copy(n.Memory[n.rxBuffer:int(n.rxBuffer)+size], frame)
+		n.rxLength = uint16(len(frame))
+		n.status = n.status&^STATUS_RX_ARMED | STATUS_RX_READY
+		if copied < len(frame) {
+			n.status |= STATUS_RX_TRUNCATED
+		}
+		log.Printf("NIC: received %d byte frame into %04X\n", len(frame), n.rxBuffer)
+	default:
+	}
+}
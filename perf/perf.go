@@ -0,0 +1,86 @@
+package perf
+
+import (
+	"code/g16/cpu"
+	"code/g16/pins"
+	"log"
+)
+
+const PERF_ADDRESS = 0xE800
+const PERF_SIZE = 0x16
+
+const ( // Register offsets from PERF_ADDRESS, one word each
+	PERF_CONTROL    = 0x00
+	PERF_CYCLES_LO  = 0x02 // Counters read their latched value, low word first
+	PERF_CYCLES_HI  = 0x04
+	PERF_RETIRED_LO = 0x06
+	PERF_RETIRED_HI = 0x08
+	PERF_READS_LO   = 0x0A
+	PERF_READS_HI   = 0x0C
+	PERF_WRITES_LO  = 0x0E
+	PERF_WRITES_HI  = 0x10
+	PERF_STALLS_LO  = 0x12
+	PERF_STALLS_HI  = 0x14
+)
+
+const (
+	CONTROL_LATCH uint16 = 1 << 0 // Snapshot every counter at once
+	CONTROL_RESET uint16 = 1 << 1 // Count from zero again
+)
+
+// Perf exposes the CPU's performance counters to the guest. The cycle
+// counter comes from cpu.up, so it counts CPU cycles, one per clock edge:
+// twice the device cycles other devices' latencies are given in.
+type Perf struct {
+	Pins    *pins.Pins
+	Source  func() cpu.PerfCounters
+	base    cpu.PerfCounters
+	latched [5]uint32 // cycles, retired, reads, writes, stalls
+}
+
+func (p *Perf) ProcessCycle() {
+	if !p.Pins.Valid {
+		return
+	}
+
+	reg := p.Pins.Address - PERF_ADDRESS
+	if p.Pins.RW { // Read
+		switch {
+		case reg == PERF_CONTROL:
+			p.Pins.Data = 0
+		case reg >= PERF_CYCLES_LO && reg < PERF_SIZE && reg%2 == 0:
+			counter := p.latched[(reg-PERF_CYCLES_LO)/4]
+			if (reg-PERF_CYCLES_LO)%4 == 0 {
+				p.Pins.Data = uint16(counter)
+			} else {
+				p.Pins.Data = uint16(counter >> 16)
+			}
+		default:
+			log.Printf("Perf: read from unmapped register %02X\n", reg)
+			p.Pins.Data = 0
+		}
+	} else { // Write
+		if reg == PERF_CONTROL {
+			if p.Pins.Data&CONTROL_RESET != 0 {
+				p.base = p.Source()
+			}
+			if p.Pins.Data&CONTROL_LATCH != 0 {
+				p.latch()
+			}
+		} else {
+			log.Printf("Perf: write %04X to read-only register %02X ignored\n", p.Pins.Data, reg)
+		}
+		p.Pins.Valid = false
+	}
+}
+
+func (p *Perf) latch() {
+	now := p.Source()
+	p.latched = [5]uint32{
+		uint32(now.Cycles - p.base.Cycles),
+		uint32(now.Retired - p.base.Retired),
+		uint32(now.Reads - p.base.Reads),
+		uint32(now.Writes - p.base.Writes),
+		uint32(now.Stalls - p.base.Stalls),
+	}
+}
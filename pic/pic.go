@@ -0,0 +1,153 @@
+package pic
+
+import (
+	"code/g16/pins"
+	"log"
+)
+
+const PIC_ADDRESS = 0xE600
+const PIC_SIZE = 0x20
+const IRQ_LINES = 8
+
+const ( // Register offsets from PIC_ADDRESS, one word each
+	PIC_MASK        = 0x00 // Bit n enables line n
+	PIC_PENDING     = 0x02 // Lines currently requesting service, read-only
+	PIC_IN_SERVICE  = 0x04 // Lines acknowledged but not yet ended, read-only
+	PIC_ACK         = 0x06 // Reading acknowledges the highest priority request and returns its vector
+	PIC_EOI         = 0x08 // Writing ends the highest priority in-service interrupt
+	PIC_VECTOR_BASE = 0x0A // Vector delivered for line n is VECTOR_BASE + n
+	PIC_PRIORITY    = 0x10 // One word per line, 0 is the highest priority
+)
+
+const ( // Input line each interrupting device is wired to
+	IRQ_RTC    = 0
+	IRQ_FB     = 1 // Framebuffer vblank
+	IRQ_VIDEO  = 2
+	IRQ_DISK   = 3
+	IRQ_SERIAL = 4
+	IRQ_GPIO   = 5
+	IRQ_NIC    = 6
+)
+
+const LOWEST_PRIORITY = 7
+const SPURIOUS_VECTOR = 0x00FF // Returned when an acknowledge finds nothing to deliver
+
+type PIC struct {
+	Pins       *pins.Pins // IRQ is the interrupt output to the CPU
+	mask       uint16
+	pending    uint16
+	inService  uint16
+	vectorBase uint16
+	priority   [IRQ_LINES]uint16
+}
+
+func (pic *PIC) Reset() {
+	pic.mask = 0
+	pic.pending = 0
+	pic.inService = 0
+	pic.vectorBase = 0
+	for line := range pic.priority {
+		pic.priority[line] = LOWEST_PRIORITY
+	}
+	pic.update()
+}
+
+// Request samples the device interrupt lines, bit n being line n. Lines are
+// level triggered, so a device keeps requesting until its handler clears it.
+func (pic *PIC) Request(lines uint16) {
+	pic.pending = lines
+	pic.update()
+}
+
+func (pic *PIC) ProcessCycle() {
+	if !pic.Pins.Valid {
+		return
+	}
+
+	reg := pic.Pins.Address - PIC_ADDRESS
+	if pic.Pins.RW { // Read
+		switch {
+		case reg == PIC_MASK:
+			pic.Pins.Data = pic.mask
+		case reg == PIC_PENDING:
+			pic.Pins.Data = pic.pending
+		case reg == PIC_IN_SERVICE:
+			pic.Pins.Data = pic.inService
+		case reg == PIC_ACK:
+			pic.Pins.Data = pic.acknowledge()
+		case reg == PIC_VECTOR_BASE:
+			pic.Pins.Data = pic.vectorBase
+		case reg >= PIC_PRIORITY && reg < PIC_SIZE:
+			pic.Pins.Data = pic.priority[(reg-PIC_PRIORITY)/2]
+		default:
+			log.Printf("PIC: read from unmapped register %02X\n", reg)
+			pic.Pins.Data = 0
+		}
+	} else { // Write
+		switch {
+		case reg == PIC_MASK:
+			pic.mask = pic.Pins.Data
+		case reg == PIC_EOI:
+			pic.endOfInterrupt()
+		case reg == PIC_VECTOR_BASE:
+			pic.vectorBase = pic.Pins.Data
+		case reg >= PIC_PRIORITY && reg < PIC_SIZE:
+			pic.priority[(reg-PIC_PRIORITY)/2] = min(pic.Pins.Data, LOWEST_PRIORITY)
+		default:
+			log.Printf("PIC: write %04X to read-only register %02X ignored\n", pic.Pins.Data, reg)
+		}
+		pic.Pins.Valid = false
+	}
+	pic.update()
+}
+
+// highest returns the line in set with the highest priority, ties going to the lowest line number.
+func (pic *PIC) highest(set uint16) (int, bool) {
+	best := -1
+	for line := range IRQ_LINES {
+		if set&(1<<line) == 0 {
+			continue
+		}
+		if best < 0 || pic.priority[line] < pic.priority[best] {
+			best = line
+		}
+	}
+	return best, best >= 0
+}
+
+// deliverable returns the line that should interrupt the CPU, if any. A
+// request must be unmasked, not already in service, and of strictly higher
+// priority than everything in service.
+func (pic *PIC) deliverable() (int, bool) {
+	line, ok := pic.highest(pic.pending & pic.mask &^ pic.inService)
+	if !ok {
+		return 0, false
+	}
+	if current, busy := pic.highest(pic.inService); busy && pic.priority[current] <= pic.priority[line] {
+		return 0, false
+	}
+	return line, true
+}
+
+func (pic *PIC) acknowledge() uint16 {
+	line, ok := pic.deliverable()
+	if !ok {
+		log.Printf("PIC: spurious acknowledge\n")
+		return SPURIOUS_VECTOR
+	}
+	pic.inService |= 1 << line
+	log.Printf("PIC: acknowledged line %d\n", line)
+	return pic.vectorBase + uint16(line)
+}
+
+func (pic *PIC) endOfInterrupt() {
+	if line, ok := pic.highest(pic.inService); ok {
+		pic.inService &^= 1 << line
+		log.Printf("PIC: end of interrupt on line %d\n", line)
+	}
+}
+
+func (pic *PIC) update() {
+	_, ok := pic.deliverable()
+	pic.Pins.IRQ = ok
+}
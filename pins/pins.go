@@ -5,4 +5,6 @@ type Pins struct {
 	Data    uint16
 	RW      bool // True = Read, False = Write
 	Valid   bool // Whether the bus cycle is active
+	IRQ     bool // Interrupt request raised by the device
+	NMI     bool // Non-maskable interrupt request, taken on the rising edge
 }
@@ -15,8 +15,18 @@ type RAM struct {
 }
 
 func (ram *RAM) Init(program []byte) {
-	copy(ram.memory[ROM_START:], program)
-	log.Printf("Loaded program into RAM at %04X\n", ROM_START)
+	ram.Load(ROM_START, program)
+}
+
+// Load copies an assembled segment into memory at its load address.
+func (ram *RAM) Load(address int, data []byte) {
+	copy(ram.memory[address:], data)
+	log.Printf("Loaded %d bytes into RAM at %04X\n", len(data), address)
+}
+
+// Memory exposes the backing store for devices that transfer data without the CPU.
+func (ram *RAM) Memory() *[RAM_SIZE]byte {
+	return &ram.memory
 }
 
 func (ram *RAM) ProcessCycle() {
@@ -0,0 +1,79 @@
+package rng
+
+import (
+	"code/g16/pins"
+	crand "crypto/rand"
+	"encoding/binary"
+	"log"
+	"math/rand/v2"
+)
+
+const RNG_ADDRESS = 0xE500
+const RNG_SIZE = 0x06
+
+const ( // Register offsets from RNG_ADDRESS, one word each
+	RNG_VALUE   = 0x00 // Each read returns the next random word
+	RNG_SEED_LO = 0x02 // Writing either seed word reseeds the generator and makes it deterministic
+	RNG_SEED_HI = 0x04
+)
+
+type RNG struct {
+	Pins          *pins.Pins
+	Deterministic bool // Use the seeded PRNG instead of host entropy
+	seed          uint32
+	source        *rand.PCG
+}
+
+// Seed restarts the deterministic generator from seed.
+func (r *RNG) Seed(seed uint32) {
+	r.Deterministic = true
+	r.seed = seed
+	r.source = rand.NewPCG(uint64(seed), 0)
+	log.Printf("RNG: seeded with %08X\n", seed)
+}
+
+func (r *RNG) ProcessCycle() {
+	if !r.Pins.Valid {
+		return
+	}
+
+	reg := r.Pins.Address - RNG_ADDRESS
+	if r.Pins.RW { // Read
+		switch reg {
+		case RNG_VALUE:
+			r.Pins.Data = r.next()
+		case RNG_SEED_LO:
+			r.Pins.Data = uint16(r.seed)
+		case RNG_SEED_HI:
+			r.Pins.Data = uint16(r.seed >> 16)
+		default:
+			log.Printf("RNG: read from unmapped register %02X\n", reg)
+			r.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case RNG_SEED_LO:
+			r.Seed(r.seed&0xFFFF0000 | uint32(r.Pins.Data))
+		case RNG_SEED_HI:
+			r.Seed(r.seed&0x0000FFFF | uint32(r.Pins.Data)<<16)
+		default:
+			log.Printf("RNG: write %04X to read-only register %02X ignored\n", r.Pins.Data, reg)
+		}
+		r.Pins.Valid = false
+	}
+}
+
+func (r *RNG) next() uint16 {
+	if !r.Deterministic {
+		var b [2]byte
+		_, err := crand.Read(b[:])
+		if err == nil {
+			return binary.LittleEndian.Uint16(b[:])
+		}
+		log.Printf("RNG: host entropy unavailable, falling back to the seeded generator: %v\n", err)
+	}
+	if r.source == nil {
+		r.Seed(r.seed)
+	}
+	return uint16(r.source.Uint64())
+}
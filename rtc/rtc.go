@@ -0,0 +1,137 @@
+package rtc
+
+import (
+	"code/g16/pins"
+	"log"
+	"time"
+)
+
+const RTC_ADDRESS = 0xE000
+const RTC_SIZE = 0x16
+
+const ( // Register offsets from RTC_ADDRESS, one word each
+	RTC_SECONDS       = 0x00 // Reading latches the full date/time
+	RTC_MINUTES       = 0x02
+	RTC_HOURS         = 0x04
+	RTC_DAY           = 0x06
+	RTC_MONTH         = 0x08
+	RTC_YEAR          = 0x0A
+	RTC_ALARM_SECONDS = 0x0C
+	RTC_ALARM_MINUTES = 0x0E
+	RTC_ALARM_HOURS   = 0x10
+	RTC_CONTROL       = 0x12
+	RTC_STATUS        = 0x14 // Write any value to clear
+)
+
+const (
+	CONTROL_ALARM_ENABLE uint16 = 1 << 0
+	CONTROL_ALARM_IRQ    uint16 = 1 << 1
+	STATUS_ALARM         uint16 = 1 << 0
+)
+
+type Mode int
+
+const (
+	VirtualTime Mode = iota // Time advances with the cycle count, reproducible between runs
+	HostTime                // Time follows the host wall clock
+)
+
+type RTC struct {
+	Pins            *pins.Pins
+	Mode            Mode
+	Epoch           time.Time // Virtual time at cycle 0, defaults to 2000-01-01 00:00:00 UTC
+	CyclesPerSecond uint64    // Cycles per virtual second
+	cycles          uint64
+	latched         time.Time
+	alarm           [3]uint16 // seconds, minutes, hours
+	control         uint16
+	status          uint16
+	alarmSecond     int64 // Unix second the alarm last fired, so it fires once per match
+}
+
+func (rtc *RTC) Now() time.Time {
+	if rtc.Mode == HostTime {
+		return time.Now()
+	}
+	epoch := rtc.Epoch
+	if epoch.IsZero() {
+		epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if rtc.CyclesPerSecond == 0 {
+		return epoch
+	}
+	return epoch.Add(time.Duration(rtc.cycles/rtc.CyclesPerSecond) * time.Second)
+}
+
+func (rtc *RTC) ProcessCycle() {
+	rtc.cycles++
+	rtc.checkAlarm()
+	rtc.Pins.IRQ = rtc.control&CONTROL_ALARM_IRQ != 0 && rtc.status&STATUS_ALARM != 0
+
+	if !rtc.Pins.Valid {
+		return
+	}
+
+	reg := rtc.Pins.Address - RTC_ADDRESS
+	if rtc.Pins.RW { // Read
+		rtc.Pins.Data = rtc.read(reg)
+	} else { // Write
+		rtc.write(reg, rtc.Pins.Data)
+		rtc.Pins.Valid = false
+	}
+}
+
+func (rtc *RTC) read(reg uint16) uint16 {
+	switch reg {
+	case RTC_SECONDS:
+		rtc.latched = rtc.Now()
+		return uint16(rtc.latched.Second())
+	case RTC_MINUTES:
+		return uint16(rtc.latched.Minute())
+	case RTC_HOURS:
+		return uint16(rtc.latched.Hour())
+	case RTC_DAY:
+		return uint16(rtc.latched.Day())
+	case RTC_MONTH:
+		return uint16(rtc.latched.Month())
+	case RTC_YEAR:
+		return uint16(rtc.latched.Year())
+	case RTC_ALARM_SECONDS, RTC_ALARM_MINUTES, RTC_ALARM_HOURS:
+		return rtc.alarm[(reg-RTC_ALARM_SECONDS)/2]
+	case RTC_CONTROL:
+		return rtc.control
+	case RTC_STATUS:
+		return rtc.status
+	default:
+		log.Printf("RTC: read from unmapped register %02X\n", reg)
+		return 0
+	}
+}
+
+func (rtc *RTC) write(reg uint16, data uint16) {
+	switch reg {
+	case RTC_ALARM_SECONDS, RTC_ALARM_MINUTES, RTC_ALARM_HOURS:
+		rtc.alarm[(reg-RTC_ALARM_SECONDS)/2] = data
+	case RTC_CONTROL:
+		rtc.control = data
+	case RTC_STATUS:
+		rtc.status = 0
+	default:
+		log.Printf("RTC: write %04X to read-only register %02X ignored\n", data, reg)
+	}
+}
+
+func (rtc *RTC) checkAlarm() {
+	if rtc.control&CONTROL_ALARM_ENABLE == 0 {
+		return
+	}
+	now := rtc.Now()
+	if now.Unix() == rtc.alarmSecond {
+		return
+	}
+	if uint16(now.Second()) == rtc.alarm[0] && uint16(now.Minute()) == rtc.alarm[1] && uint16(now.Hour()) == rtc.alarm[2] {
+		log.Printf("RTC: alarm at %s\n", now.Format(time.TimeOnly))
+		rtc.status |= STATUS_ALARM
+		rtc.alarmSecond = now.Unix()
+	}
+}
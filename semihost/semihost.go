@@ -0,0 +1,271 @@
+package semihost
+
+import (
+	"code/g16/pins"
+	"code/g16/ram"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+)
+
+const SEMIHOST_ADDRESS = 0xE700
+const SEMIHOST_SIZE = 0x06
+
+const ( // Register offsets from SEMIHOST_ADDRESS, one word each
+	SEMIHOST_PARAMS = 0x00 // RAM address of the call's parameter block
+	SEMIHOST_CALL   = 0x02 // Writing a call number performs the call immediately
+	SEMIHOST_RESULT = 0x04 // Result of the last call, ERROR on failure
+)
+
+// Calls and their parameter blocks, one word per parameter. Strings and
+// buffers are byte-packed in RAM.
+const (
+	CALL_OPEN  uint16 = 1 // path, path length, mode -> handle
+	CALL_CLOSE uint16 = 2 // handle
+	CALL_READ  uint16 = 3 // handle, buffer, length -> bytes read
+	CALL_WRITE uint16 = 4 // handle, buffer, length -> bytes written
+	CALL_ARGC  uint16 = 5 // -> argument count
+	CALL_ARGV  uint16 = 6 // index, buffer, buffer length -> argument length
+	CALL_EXIT  uint16 = 7 // status
+)
+
+// Open modes. Paths are resolved inside Root when it is set, so a guest
+// cannot create or truncate files outside that directory.
+const (
+	MODE_READ   uint16 = 0
+	MODE_WRITE  uint16 = 1 // Create or truncate
+	MODE_APPEND uint16 = 2
+)
+
+const ERROR = 0xFFFF
+
+const ( // Handles open from the start
+	STDIN  = 0
+	STDOUT = 1
+	STDERR = 2
+)
+
+type Semihost struct {
+	Pins     *pins.Pins
+	Memory   *[ram.RAM_SIZE]byte       // Parameter blocks and buffers are accessed straight in RAM
+	IsRAM    func(address uint16) bool // Reports addresses the bus routes to RAM; blocks and buffers must lie there
+	Root     *os.Root                  // Guest paths open inside this directory; nil allows any host path
+	Args     []string                  // Command-line arguments visible to the guest
+	Exited   bool
+	ExitCode int
+	params   uint16
+	result   uint16
+	files    map[uint16]*os.File
+	next     uint16
+}
+
+func (s *Semihost) Reset() {
+	s.Close()
+	s.files = map[uint16]*os.File{STDIN: os.Stdin, STDOUT: os.Stdout, STDERR: os.Stderr}
+	s.next = STDERR + 1
+	s.params = 0
+	s.result = 0
+	s.Exited = false
+	s.ExitCode = 0
+}
+
+// Close releases every host file the guest left open.
+func (s *Semihost) Close() {
+	for handle, file := range s.files {
+		if handle > STDERR {
+			file.Close()
+		}
+	}
+	s.files = nil
+}
+
+func (s *Semihost) ProcessCycle() {
+	if !s.Pins.Valid {
+		return
+	}
+
+	reg := s.Pins.Address - SEMIHOST_ADDRESS
+	if s.Pins.RW { // Read
+		switch reg {
+		case SEMIHOST_PARAMS:
+			s.Pins.Data = s.params
+		case SEMIHOST_RESULT:
+			s.Pins.Data = s.result
+		default:
+			log.Printf("Semihost: read from unmapped register %02X\n", reg)
+			s.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case SEMIHOST_PARAMS:
+			s.params = s.Pins.Data
+		case SEMIHOST_CALL:
+			s.result = s.call(s.Pins.Data)
+		default:
+			log.Printf("Semihost: write %04X to unmapped register %02X ignored\n", s.Pins.Data, reg)
+		}
+		s.Pins.Valid = false
+	}
+}
+
+// Number of parameter words each call reads.
+var paramCounts = map[uint16]int{
+	CALL_OPEN:  3,
+	CALL_CLOSE: 1,
+	CALL_READ:  3,
+	CALL_WRITE: 3,
+	CALL_ARGV:  3,
+	CALL_EXIT:  1,
+}
+
+// param returns the nth word of the parameter block.
+func (s *Semihost) param(n uint16) uint16 {
+	addr := int(s.params) + int(n)*2
+	if addr+2 > ram.RAM_SIZE {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(s.Memory[addr : addr+2])
+}
+
+// buffer returns the slice of RAM a call reads from or writes to, clipped
+// to the end of memory. It fails if the slice reaches into a device
+// window, where the CPU would not see what the call wrote.
+func (s *Semihost) buffer(addr uint16, length uint16) ([]byte, bool) {
+	end := min(int(addr)+int(length), ram.RAM_SIZE)
+	if !s.inRAM(int(addr), end) {
+		return nil, false
+	}
+	return s.Memory[addr:end], true
+}
+
+// inRAM reports whether every address from start up to end is RAM.
+func (s *Semihost) inRAM(start int, end int) bool {
+	if s.IsRAM == nil {
+		return true
+	}
+	for address := start; address < end; address++ {
+		if !s.IsRAM(uint16(address)) {
+			log.Printf("Semihost: %04X-%04X overlaps the device window at %04X\n", start, end-1, address)
+			return false
+		}
+	}
+	return true
+}
+
+// allocate returns the next handle not already open, wrapping past ERROR
+// back to the first one after the standard streams. It returns ERROR once
+// every handle is in use.
+func (s *Semihost) allocate() uint16 {
+	for range ERROR - STDERR - 1 {
+		handle := s.next
+		s.next++
+		if s.next == ERROR {
+			s.next = STDERR + 1
+		}
+		if _, used := s.files[handle]; !used {
+			return handle
+		}
+	}
+	return ERROR
+}
+
+func (s *Semihost) call(number uint16) uint16 {
+	if !s.inRAM(int(s.params), min(int(s.params)+paramCounts[number]*2, ram.RAM_SIZE)) {
+		return ERROR
+	}
+	switch number {
+	case CALL_OPEN:
+		name, ok := s.buffer(s.param(0), s.param(1))
+		if !ok {
+			return ERROR
+		}
+		path := string(name)
+		handle := s.allocate()
+		if handle == ERROR {
+			log.Printf("Semihost: open %s: every handle is in use\n", path)
+			return ERROR
+		}
+		flags := os.O_RDONLY
+		switch s.param(2) {
+		case MODE_WRITE:
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		case MODE_APPEND:
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		var file *os.File
+		var err error
+		if s.Root != nil {
+			file, err = s.Root.OpenFile(path, flags, 0o644)
+		} else {
+			file, err = os.OpenFile(path, flags, 0o644)
+		}
+		if err != nil {
+			log.Printf("Semihost: open %s: %v\n", path, err)
+			return ERROR
+		}
+		s.files[handle] = file
+		log.Printf("Semihost: opened %s as handle %d\n", path, handle)
+		return handle
+	case CALL_CLOSE:
+		handle := s.param(0)
+		file, ok := s.files[handle]
+		if !ok || handle <= STDERR {
+			return ERROR
+		}
+		delete(s.files, handle)
+		if err := file.Close(); err != nil {
+			return ERROR
+		}
+		return 0
+	case CALL_READ:
+		file, ok := s.files[s.param(0)]
+		if !ok {
+			return ERROR
+		}
+		buffer, ok := s.buffer(s.param(1), s.param(2))
+		if !ok {
+			return ERROR
+		}
+		n, err := file.Read(buffer)
+		if err != nil && err != io.EOF {
+			return ERROR
+		}
+		return uint16(n)
+	case CALL_WRITE:
+		file, ok := s.files[s.param(0)]
+		if !ok {
+			return ERROR
+		}
+		buffer, ok := s.buffer(s.param(1), s.param(2))
+		if !ok {
+			return ERROR
+		}
+		n, err := file.Write(buffer)
+		if err != nil {
+			return ERROR
+		}
+		return uint16(n)
+	case CALL_ARGC:
+		return uint16(len(s.Args))
+	case CALL_ARGV:
+		index := int(s.param(0))
+		if index >= len(s.Args) {
+			return ERROR
+		}
+		buffer, ok := s.buffer(s.param(1), s.param(2))
+		if !ok {
+			return ERROR
+		}
+		copy(buffer, s.Args[index])
+		return uint16(len(s.Args[index]))
+	case CALL_EXIT:
+		s.Exited = true
+		s.ExitCode = int(s.param(0))
+		log.Printf("Semihost: guest exited with status %d\n", s.ExitCode)
+		return 0
+	default:
+		log.Printf("Semihost: unknown call %d\n", number)
+		return ERROR
+	}
+}
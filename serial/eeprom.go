@@ -0,0 +1,57 @@
+package serial
+
+import "log"
+
+const EEPROM_I2C_ADDRESS = 0x50
+const EEPROM_SIZE = 32 * 1024 // 24C256
+const EEPROM_PAGE_SIZE = 64
+
+// EEPROM is a 24C-series I2C EEPROM with a two-byte word address. Writes wrap
+// within their page and reads run sequentially through the whole array.
+type EEPROM struct {
+	image
+	Address      uint8
+	pointer      int
+	addressBytes int // Word address bytes received since the last write start
+}
+
+func OpenEEPROM(path string, size int, address uint8, create bool) (*EEPROM, error) {
+	img, err := openImage(path, size, create)
+	if err != nil {
+		return nil, err
+	}
+	return &EEPROM{image: img, Address: address}, nil
+}
+
+func (e *EEPROM) Start(address uint8, read bool) bool {
+	if address != e.Address {
+		return false
+	}
+	if !read {
+		e.addressBytes = 0
+	}
+	return true
+}
+
+func (e *EEPROM) Write(b byte) bool {
+	if e.addressBytes < 2 {
+		e.pointer = (e.pointer<<8 | int(b)) % e.size
+		e.addressBytes++
+		return true
+	}
+	if err := e.write(e.pointer, b); err != nil {
+		log.Printf("EEPROM: %v\n", err)
+		return false
+	}
+	page := e.pointer &^ (EEPROM_PAGE_SIZE - 1)
+	e.pointer = page | (e.pointer+1)&(EEPROM_PAGE_SIZE-1)
+	return true
+}
+
+func (e *EEPROM) Read(ack bool) byte {
+	b := e.read(e.pointer)
+	e.pointer = (e.pointer + 1) % e.size
+	return b
+}
+
+func (e *EEPROM) Stop() {}
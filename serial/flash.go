@@ -0,0 +1,116 @@
+package serial
+
+import "log"
+
+const FLASH_SIZE = 1024 * 1024 // 25Q80
+const FLASH_PAGE_SIZE = 256
+const FLASH_SECTOR_SIZE = 4096
+
+const ( // SPI flash instructions
+	FLASH_WRITE_ENABLE  = 0x06
+	FLASH_WRITE_DISABLE = 0x04
+	FLASH_READ_STATUS   = 0x05
+	FLASH_READ          = 0x03
+	FLASH_PAGE_PROGRAM  = 0x02
+	FLASH_SECTOR_ERASE  = 0x20
+	FLASH_CHIP_ERASE    = 0xC7
+	FLASH_JEDEC_ID      = 0x9F
+)
+
+const FLASH_STATUS_WEL = 1 << 1 // Write enable latch
+
+var flashJEDECID = [3]byte{0xEF, 0x40, 0x14}
+
+// Flash is a 25-series SPI NOR flash. Programming can only clear bits, erases
+// set them back to 1, and both need a write enable first. Erases run when chip
+// select is released.
+type Flash struct {
+	image
+	command byte
+	count   int // Bytes transferred since chip select
+	address int
+	wel     bool
+}
+
+func OpenFlash(path string, size int, create bool) (*Flash, error) {
+	img, err := openImage(path, size, create)
+	if err != nil {
+		return nil, err
+	}
+	return &Flash{image: img}, nil
+}
+
+func (f *Flash) Select(selected bool) {
+	if selected {
+		f.count = 0
+		return
+	}
+	switch {
+	case f.count == 4 && f.command == FLASH_SECTOR_ERASE && f.wel:
+		f.erase(f.address&^(FLASH_SECTOR_SIZE-1), FLASH_SECTOR_SIZE)
+		f.wel = false
+	case f.count == 1 && f.command == FLASH_CHIP_ERASE && f.wel:
+		f.erase(0, f.size)
+		f.wel = false
+	case f.command == FLASH_PAGE_PROGRAM && f.count > 4:
+		f.wel = false
+	}
+}
+
+func (f *Flash) erase(start int, length int) {
+	log.Printf("Flash: erasing %d bytes at %06X\n", length, start)
+	if err := f.fill(start, length, 0xFF); err != nil {
+		log.Printf("Flash: %v\n", err)
+	}
+}
+
+func (f *Flash) Transfer(out byte) byte {
+	f.count++
+	if f.count == 1 {
+		f.command = out
+		f.address = 0
+		switch out {
+		case FLASH_WRITE_ENABLE:
+			f.wel = true
+		case FLASH_WRITE_DISABLE:
+			f.wel = false
+		}
+		return 0xFF
+	}
+
+	switch f.command {
+	case FLASH_READ_STATUS:
+		if f.wel {
+			return FLASH_STATUS_WEL
+		}
+		return 0
+	case FLASH_JEDEC_ID:
+		if f.count-2 < len(flashJEDECID) {
+			return flashJEDECID[f.count-2]
+		}
+		return 0xFF
+	case FLASH_READ, FLASH_PAGE_PROGRAM, FLASH_SECTOR_ERASE:
+		if f.count <= 4 { // Three address bytes, most significant first
+			f.address = (f.address<<8 | int(out)) % f.size
+			return 0xFF
+		}
+	default:
+		return 0xFF
+	}
+
+	switch f.command {
+	case FLASH_READ:
+		b := f.read(f.address)
+		f.address = (f.address + 1) % f.size
+		return b
+	case FLASH_PAGE_PROGRAM:
+		if f.wel {
+			if err := f.write(f.address, f.read(f.address)&out); err != nil {
+				log.Printf("Flash: %v\n", err)
+			}
+		}
+		page := f.address &^ (FLASH_PAGE_SIZE - 1)
+		f.address = page | (f.address+1)&(FLASH_PAGE_SIZE-1)
+	}
+	return 0xFF
+}
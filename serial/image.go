@@ -0,0 +1,62 @@
+package serial
+
+import (
+	"bytes"
+	"os"
+)
+
+// image is a host file holding the contents of a storage chip.
+type image struct {
+	file *os.File
+	size int
+}
+
+// openImage opens the file, padding it to size with erased (0xFF) bytes. A
+// missing file is an error unless create is set, so a mistyped path does
+// not silently become a blank chip.
+func openImage(path string, size int, create bool) (image, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return image{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return image{}, err
+	}
+	if info.Size() < int64(size) {
+		padding := bytes.Repeat([]byte{0xFF}, size-int(info.Size()))
+		if _, err := file.WriteAt(padding, info.Size()); err != nil {
+			file.Close()
+			return image{}, err
+		}
+	}
+	return image{file: file, size: size}, nil
+}
+
+func (img image) read(address int) byte {
+	var b [1]byte
+	if _, err := img.file.ReadAt(b[:], int64(address%img.size)); err != nil {
+		return 0xFF
+	}
+	return b[0]
+}
+
+func (img image) write(address int, value byte) error {
+	_, err := img.file.WriteAt([]byte{value}, int64(address%img.size))
+	return err
+}
+
+// fill sets length bytes from address to value in one write.
+func (img image) fill(address int, length int, value byte) error {
+	_, err := img.file.WriteAt(bytes.Repeat([]byte{value}, length), int64(address))
+	return err
+}
+
+func (img image) Close() error {
+	return img.file.Close()
+}
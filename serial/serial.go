@@ -0,0 +1,210 @@
+package serial
+
+import (
+	"code/g16/pins"
+	"fmt"
+	"log"
+)
+
+const SERIAL_ADDRESS = 0xEC00
+const SERIAL_SIZE = 0x0A
+
+const ( // Register offsets from SERIAL_ADDRESS, one word each
+	SERIAL_CONTROL = 0x00
+	SERIAL_DATA    = 0x02 // Shift register, low byte: written before a send, read after a receive
+	SERIAL_COMMAND = 0x04 // Writing a command starts it
+	SERIAL_SELECT  = 0x06 // SPI chip select, bit n selects the slave attached at n
+	SERIAL_STATUS  = 0x08
+)
+
+const (
+	CONTROL_I2C uint16 = 1 << 0 // Clear for SPI
+	CONTROL_IRQ uint16 = 1 << 1 // Interrupt when a command completes
+)
+
+const (
+	CMD_TRANSFER  uint16 = 1 // SPI: exchange DATA with the selected slaves
+	CMD_START     uint16 = 2 // I2C: (repeated) start, then send DATA as address<<1 | read
+	CMD_WRITE     uint16 = 3 // I2C: send DATA
+	CMD_READ_ACK  uint16 = 4 // I2C: receive into DATA and acknowledge
+	CMD_READ_NACK uint16 = 5 // I2C: receive into DATA without acknowledging, ending a read
+	CMD_STOP      uint16 = 6 // I2C: stop
+)
+
+const (
+	STATUS_BUSY uint16 = 1 << 0
+	STATUS_DONE uint16 = 1 << 1 // Sticky, write 1 to clear
+	STATUS_ACK  uint16 = 1 << 2 // The slave acknowledged the last I2C address or byte
+)
+
+const SPI_SLAVES = 8
+const DEFAULT_BIT_CYCLES = 1 // Cycles per bit on the wire
+
+// SPIDevice is a slave on the SPI bus.
+type SPIDevice interface {
+	Select(selected bool)
+	Transfer(out byte) byte
+}
+
+// I2CDevice is a slave on the I2C bus.
+type I2CDevice interface {
+	Start(address uint8, read bool) bool // Reports whether the device answers to address
+	Write(b byte) bool                   // Reports acknowledge
+	Read(ack bool) byte
+	Stop()
+}
+
+type Serial struct {
+	Pins      *pins.Pins
+	BitCycles uint64
+	spi       [SPI_SLAVES]SPIDevice
+	i2c       []I2CDevice
+	active    I2CDevice // The I2C device addressed by the last start
+	control   uint16
+	data      uint8
+	command   uint16
+	selected  uint16
+	status    uint16
+	wait      uint64
+}
+
+func (s *Serial) AttachSPI(cs int, device SPIDevice) error {
+	if cs < 0 || cs >= SPI_SLAVES {
+		return fmt.Errorf("chip select %d out of range 0-%d", cs, SPI_SLAVES-1)
+	}
+	s.spi[cs] = device
+	return nil
+}
+
+func (s *Serial) AttachI2C(device I2CDevice) {
+	s.i2c = append(s.i2c, device)
+}
+
+func (s *Serial) ProcessCycle() {
+	s.tick()
+
+	if !s.Pins.Valid {
+		return
+	}
+
+	reg := s.Pins.Address - SERIAL_ADDRESS
+	if s.Pins.RW { // Read
+		switch reg {
+		case SERIAL_CONTROL:
+			s.Pins.Data = s.control
+		case SERIAL_DATA:
+			s.Pins.Data = uint16(s.data)
+		case SERIAL_COMMAND:
+			s.Pins.Data = s.command
+		case SERIAL_SELECT:
+			s.Pins.Data = s.selected
+		case SERIAL_STATUS:
+			s.Pins.Data = s.status
+		default:
+			log.Printf("Serial: read from unmapped register %02X\n", reg)
+			s.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case SERIAL_CONTROL:
+			s.control = s.Pins.Data
+		case SERIAL_DATA:
+			s.data = uint8(s.Pins.Data)
+		case SERIAL_COMMAND:
+			if s.status&STATUS_BUSY != 0 {
+				log.Printf("Serial: command %d while busy ignored\n", s.Pins.Data)
+				break
+			}
+			s.command = s.Pins.Data
+			s.status = s.status&^STATUS_DONE | STATUS_BUSY
+			s.wait = 8 * s.BitCycles
+			if s.command == CMD_START || s.command == CMD_STOP {
+				s.wait = s.BitCycles
+			}
+		case SERIAL_SELECT:
+			s.chipSelect(s.Pins.Data)
+		case SERIAL_STATUS:
+			s.status &^= s.Pins.Data & STATUS_DONE
+		default:
+			log.Printf("Serial: write %04X to unmapped register %02X ignored\n", s.Pins.Data, reg)
+		}
+		s.Pins.Valid = false
+	}
+}
+
+func (s *Serial) chipSelect(selected uint16) {
+	for n, device := range s.spi {
+		if device == nil {
+			continue
+		}
+		was, is := s.selected&(1<<n) != 0, selected&(1<<n) != 0
+		if was != is {
+			device.Select(is)
+		}
+	}
+	s.selected = selected
+}
+
+// tick waits out the time the current command spends on the wire, then performs it.
+func (s *Serial) tick() {
+	if s.status&STATUS_BUSY != 0 {
+		if s.wait > 0 {
+			s.wait--
+		} else {
+			s.execute()
+			s.status = s.status&^STATUS_BUSY | STATUS_DONE
+		}
+	}
+	s.Pins.IRQ = s.control&CONTROL_IRQ != 0 && s.status&STATUS_DONE != 0
+}
+
+func (s *Serial) execute() {
+	if s.control&CONTROL_I2C == 0 {
+		if s.command != CMD_TRANSFER {
+			log.Printf("Serial: command %d is not an SPI command\n", s.command)
+			return
+		}
+		in := uint8(0xFF) // Nothing driving MISO reads as all ones
+		for n, device := range s.spi {
+			if device != nil && s.selected&(1<<n) != 0 {
+				in &= device.Transfer(s.data)
+			}
+		}
+		s.data = in
+		return
+	}
+
+	s.status &^= STATUS_ACK
+	ack := false
+	switch s.command {
+	case CMD_START:
+		if s.active != nil {
+			s.active.Stop()
+		}
+		s.active = nil
+		for _, device := range s.i2c {
+			if device.Start(s.data>>1, s.data&1 != 0) {
+				s.active = device
+				ack = true
+				break
+			}
+		}
+	case CMD_WRITE:
+		ack = s.active != nil && s.active.Write(s.data)
+	case CMD_READ_ACK, CMD_READ_NACK:
+		s.data = 0xFF
+		if s.active != nil {
+			s.data = s.active.Read(s.command == CMD_READ_ACK)
+		}
+	case CMD_STOP:
+		if s.active != nil {
+			s.active.Stop()
+		}
+		s.active = nil
+	default:
+		log.Printf("Serial: command %d is not an I2C command\n", s.command)
+	}
+	if ack {
+		s.status |= STATUS_ACK
+	}
+}
@@ -0,0 +1,174 @@
+package sound
+
+import (
+	"code/g16/pins"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+)
+
+const SOUND_ADDRESS = 0xE300
+const SOUND_SIZE = 0x10
+
+const TONE_CHANNELS = 3
+const CHANNELS = TONE_CHANNELS + 1 // The last channel is noise
+
+const ( // Register offsets from SOUND_ADDRESS, one word each
+	SOUND_TONE0_DIVIDER = 0x00 // Square wave toggles every DIVIDER cycles, 0 = silent
+	SOUND_TONE0_VOLUME  = 0x02 // 0-15
+	SOUND_TONE1_DIVIDER = 0x04
+	SOUND_TONE1_VOLUME  = 0x06
+	SOUND_TONE2_DIVIDER = 0x08
+	SOUND_TONE2_VOLUME  = 0x0A
+	SOUND_NOISE_DIVIDER = 0x0C // The noise LFSR shifts every DIVIDER cycles
+	SOUND_NOISE_VOLUME  = 0x0E
+)
+
+const MAX_VOLUME = 15
+const DEFAULT_SAMPLE_RATE = 22050
+const LFSR_SEED = 0x4000
+
+type channel struct {
+	divider uint16
+	volume  uint16
+	counter uint16
+	high    bool
+}
+
+type Sound struct {
+	Pins            *pins.Pins
+	CyclesPerSecond uint64 // Emulated clock rate the dividers count against
+	SampleRate      uint64
+	channels        [CHANNELS]channel
+	lfsr            uint16
+	accumulator     uint64
+	samples         []int16
+}
+
+func (s *Sound) Reset() {
+	s.channels = [CHANNELS]channel{}
+	s.lfsr = LFSR_SEED
+	s.accumulator = 0
+	s.samples = nil
+	if s.SampleRate == 0 {
+		s.SampleRate = DEFAULT_SAMPLE_RATE
+	}
+}
+
+func (s *Sound) ProcessCycle() {
+	s.tick()
+
+	if !s.Pins.Valid {
+		return
+	}
+
+	reg := s.Pins.Address - SOUND_ADDRESS
+	ch := &s.channels[reg/4]
+	if s.Pins.RW { // Read
+		if reg%4 == 0 {
+			s.Pins.Data = ch.divider
+		} else {
+			s.Pins.Data = ch.volume
+		}
+	} else { // Write
+		if reg%4 == 0 {
+			ch.divider = s.Pins.Data
+			ch.counter = 0
+		} else {
+			if s.Pins.Data > MAX_VOLUME {
+				log.Printf("Sound: volume %d clamped to %d\n", s.Pins.Data, MAX_VOLUME)
+			}
+			ch.volume = min(s.Pins.Data, MAX_VOLUME)
+		}
+		s.Pins.Valid = false
+	}
+}
+
+// tick advances every channel by one cycle and emits however many samples
+// fall within it at SampleRate.
+func (s *Sound) tick() {
+	for i := range s.channels {
+		ch := &s.channels[i]
+		if ch.divider == 0 {
+			continue
+		}
+		ch.counter++
+		if ch.counter < ch.divider {
+			continue
+		}
+		ch.counter = 0
+		if i < TONE_CHANNELS {
+			ch.high = !ch.high
+		} else {
+			feedback := (s.lfsr ^ s.lfsr>>1) & 1
+			s.lfsr = s.lfsr>>1 | feedback<<14
+			ch.high = s.lfsr&1 != 0
+		}
+	}
+
+	if s.CyclesPerSecond == 0 {
+		return
+	}
+	s.accumulator += s.SampleRate
+	for s.accumulator >= s.CyclesPerSecond {
+		s.accumulator -= s.CyclesPerSecond
+		s.samples = append(s.samples, s.mix())
+	}
+}
+
+func (s *Sound) mix() int16 {
+	const step = 32767 / CHANNELS / MAX_VOLUME
+	var sample int
+	for _, ch := range s.channels {
+		if ch.divider == 0 {
+			continue
+		}
+		level := int(ch.volume) * step
+		if !ch.high {
+			level = -level
+		}
+		sample += level
+	}
+	return int16(sample)
+}
+
+// Samples returns the mono 16-bit signed samples rendered so far.
+func (s *Sound) Samples() []int16 {
+	return s.samples
+}
+
+// WriteWAV writes the rendered samples as a mono 16-bit PCM WAV file.
+func (s *Sound) WriteWAV(w io.Writer) error {
+	const bytesPerSample = 2
+	dataSize := uint32(len(s.samples) * bytesPerSample)
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16),
+		uint16(1), // PCM
+		uint16(1), // Mono
+		uint32(s.SampleRate),
+		uint32(s.SampleRate * bytesPerSample),
+		uint16(bytesPerSample),
+		uint16(8 * bytesPerSample),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, s.samples)
+}
+
+func (s *Sound) SaveWAV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := s.WriteWAV(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,278 @@
+package video
+
+import (
+	"code/g16/framebuffer"
+	"code/g16/pins"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+)
+
+const WIDTH = 256
+const HEIGHT = 192
+const TILE_SIZE = 8
+const TILE_BYTES = TILE_SIZE * TILE_SIZE / 2 // 4bpp, left pixel in the low nibble
+const COLUMNS = WIDTH / TILE_SIZE
+const ROWS = HEIGHT / TILE_SIZE
+const SPRITE_COUNT = 8
+
+const VRAM_SIZE = 0x4000
+const PATTERN_TABLE = 0x0000 // 256 tiles of TILE_BYTES each
+const NAME_TABLE = 0x2000    // COLUMNS x ROWS tile numbers, one byte each
+
+const VIDEO_ADDRESS = 0xE200
+const VIDEO_SIZE = 0x80
+
+const ( // Register offsets from VIDEO_ADDRESS, one word each
+	VIDEO_VRAM_ADDRESS     = 0x00
+	VIDEO_VRAM_DATA        = 0x02 // Byte port into VRAM, VRAM_ADDRESS increments after each access
+	VIDEO_CONTROL          = 0x04
+	VIDEO_STATUS           = 0x06 // Write 1s to clear sticky bits
+	VIDEO_SPRITE_COLLISION = 0x08 // Bit n: sprite n overlapped another sprite; write 1s to clear
+	VIDEO_BG_COLLISION     = 0x0A // Bit n: sprite n overlapped a non-zero background pixel; write 1s to clear
+	VIDEO_PALETTE          = 0x20 // 16 RGB565 entries, 0x20-0x3E
+	VIDEO_SPRITES          = 0x40 // SPRITE_COUNT entries of SPRITE_X, SPRITE_Y, SPRITE_TILE, SPRITE_ATTR
+)
+
+const ( // Per-sprite register offsets
+	SPRITE_X    = 0x0
+	SPRITE_Y    = 0x2
+	SPRITE_TILE = 0x4
+	SPRITE_ATTR = 0x6
+	SPRITE_SIZE = 0x8
+)
+
+const (
+	CONTROL_DISPLAY    uint16 = 1 << 0
+	CONTROL_VBLANK_IRQ uint16 = 1 << 1
+	STATUS_IN_VBLANK   uint16 = 1 << 0
+	STATUS_VBLANK      uint16 = 1 << 1
+	ATTR_VISIBLE       uint16 = 1 << 0
+	ATTR_FLIP_X        uint16 = 1 << 1
+	ATTR_FLIP_Y        uint16 = 1 << 2
+)
+
+type sprite struct {
+	x, y, tile, attr uint16
+}
+
+type Video struct {
+	Pins            *pins.Pins
+	CyclesPerFrame  uint64
+	vram            [VRAM_SIZE]byte
+	vramAddress     uint16
+	palette         [framebuffer.PALETTE_SIZE]uint16
+	sprites         [SPRITE_COUNT]sprite
+	control         uint16
+	status          uint16
+	spriteCollision uint16
+	bgCollision     uint16
+	cycles          uint64
+	frame           [HEIGHT][WIDTH]uint8 // Palette indices of the last composed frame
+}
+
+func (v *Video) Reset() {
+	v.vram = [VRAM_SIZE]byte{}
+	v.vramAddress = 0
+	v.palette = framebuffer.DefaultPalette
+	v.sprites = [SPRITE_COUNT]sprite{}
+	v.control = CONTROL_DISPLAY
+	v.status = 0
+	v.spriteCollision = 0
+	v.bgCollision = 0
+	v.cycles = 0
+	v.frame = [HEIGHT][WIDTH]uint8{}
+	if v.CyclesPerFrame == 0 {
+		v.CyclesPerFrame = framebuffer.DEFAULT_CYCLES_PER_FRAME
+	}
+}
+
+func (v *Video) ProcessCycle() {
+	v.tick()
+
+	if !v.Pins.Valid {
+		return
+	}
+
+	reg := v.Pins.Address - VIDEO_ADDRESS
+	if v.Pins.RW { // Read
+		v.Pins.Data = v.read(reg)
+	} else { // Write
+		v.write(reg, v.Pins.Data)
+		v.Pins.Valid = false
+	}
+}
+
+// tick advances the beam by one cycle. The frame is composed, and collisions
+// latched, at the start of vertical blank.
+func (v *Video) tick() {
+	v.cycles++
+	position := v.cycles % v.CyclesPerFrame
+	blankStart := v.CyclesPerFrame - v.CyclesPerFrame/framebuffer.VBLANK_FRACTION
+
+	switch {
+	case position == blankStart:
+		spriteCollision, bgCollision := v.compose()
+		v.spriteCollision |= spriteCollision
+		v.bgCollision |= bgCollision
+		v.status |= STATUS_IN_VBLANK | STATUS_VBLANK
+	case position == 0:
+		v.status &^= STATUS_IN_VBLANK
+	}
+	v.Pins.IRQ = v.control&CONTROL_VBLANK_IRQ != 0 && v.status&STATUS_VBLANK != 0
+}
+
+func (v *Video) read(reg uint16) uint16 {
+	switch {
+	case reg == VIDEO_VRAM_ADDRESS:
+		return v.vramAddress
+	case reg == VIDEO_VRAM_DATA:
+		data := uint16(v.vram[v.vramAddress%VRAM_SIZE])
+		v.vramAddress++
+		return data
+	case reg == VIDEO_CONTROL:
+		return v.control
+	case reg == VIDEO_STATUS:
+		return v.status
+	case reg == VIDEO_SPRITE_COLLISION:
+		return v.spriteCollision
+	case reg == VIDEO_BG_COLLISION:
+		return v.bgCollision
+	case reg >= VIDEO_PALETTE && reg < VIDEO_SPRITES:
+		return v.palette[(reg-VIDEO_PALETTE)/2]
+	case reg >= VIDEO_SPRITES && reg < VIDEO_SIZE:
+		s := &v.sprites[(reg-VIDEO_SPRITES)/SPRITE_SIZE]
+		return *s.field((reg - VIDEO_SPRITES) % SPRITE_SIZE)
+	default:
+		log.Printf("Video: read from unmapped register %02X\n", reg)
+		return 0
+	}
+}
+
+func (v *Video) write(reg uint16, data uint16) {
+	switch {
+	case reg == VIDEO_VRAM_ADDRESS:
+		v.vramAddress = data
+	case reg == VIDEO_VRAM_DATA:
+		v.vram[v.vramAddress%VRAM_SIZE] = byte(data)
+		v.vramAddress++
+	case reg == VIDEO_CONTROL:
+		v.control = data
+	case reg == VIDEO_STATUS:
+		v.status &^= data & STATUS_VBLANK
+	case reg == VIDEO_SPRITE_COLLISION:
+		v.spriteCollision &^= data
+	case reg == VIDEO_BG_COLLISION:
+		v.bgCollision &^= data
+	case reg >= VIDEO_PALETTE && reg < VIDEO_SPRITES:
+		v.palette[(reg-VIDEO_PALETTE)/2] = data
+	case reg >= VIDEO_SPRITES && reg < VIDEO_SIZE:
+		s := &v.sprites[(reg-VIDEO_SPRITES)/SPRITE_SIZE]
+		*s.field((reg - VIDEO_SPRITES) % SPRITE_SIZE) = data
+	default:
+		log.Printf("Video: write %04X to unmapped register %02X ignored\n", data, reg)
+	}
+}
+
+func (s *sprite) field(offset uint16) *uint16 {
+	switch offset {
+	case SPRITE_X:
+		return &s.x
+	case SPRITE_Y:
+		return &s.y
+	case SPRITE_TILE:
+		return &s.tile
+	default:
+		return &s.attr
+	}
+}
+
+// tilePixel returns the palette index of pixel (x, y) of a pattern table tile.
+func (v *Video) tilePixel(tile uint8, x int, y int) uint8 {
+	b := v.vram[PATTERN_TABLE+int(tile)*TILE_BYTES+(y*TILE_SIZE+x)/2]
+	if x%2 == 1 {
+		return b >> 4
+	}
+	return b & 0x0F
+}
+
+// compose draws the name table and sprites into the frame and returns the
+// collision bits. Sprite 0 has the highest priority and colour 0 is transparent.
+func (v *Video) compose() (spriteCollision uint16, bgCollision uint16) {
+	if v.control&CONTROL_DISPLAY == 0 {
+		v.frame = [HEIGHT][WIDTH]uint8{}
+		return 0, 0
+	}
+
+	for y := range HEIGHT {
+		for x := range WIDTH {
+			tile := v.vram[NAME_TABLE+(y/TILE_SIZE)*COLUMNS+x/TILE_SIZE]
+			v.frame[y][x] = v.tilePixel(tile, x%TILE_SIZE, y%TILE_SIZE)
+		}
+	}
+
+	var owner [HEIGHT][WIDTH]int8 // Highest priority sprite drawn at each pixel, plus one
+	for n := SPRITE_COUNT - 1; n >= 0; n-- {
+		s := v.sprites[n]
+		if s.attr&ATTR_VISIBLE == 0 {
+			continue
+		}
+		for ty := range TILE_SIZE {
+			for tx := range TILE_SIZE {
+				x, y := int(s.x)+tx, int(s.y)+ty
+				if x >= WIDTH || y >= HEIGHT {
+					continue
+				}
+				px, py := tx, ty
+				if s.attr&ATTR_FLIP_X != 0 {
+					px = TILE_SIZE - 1 - tx
+				}
+				if s.attr&ATTR_FLIP_Y != 0 {
+					py = TILE_SIZE - 1 - ty
+				}
+				index := v.tilePixel(uint8(s.tile), px, py)
+				if index == 0 {
+					continue
+				}
+				if other := owner[y][x]; other != 0 {
+					spriteCollision |= 1<<n | 1<<(other-1)
+				} else if v.frame[y][x] != 0 {
+					bgCollision |= 1 << n
+				}
+				owner[y][x] = int8(n + 1)
+				v.frame[y][x] = index
+			}
+		}
+	}
+	return spriteCollision, bgCollision
+}
+
+// Image composes the current VRAM and sprite state and renders it through the palette.
+func (v *Video) Image() *image.RGBA {
+	v.compose()
+	img := image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
+	for y := range HEIGHT {
+		for x := range WIDTH {
+			img.SetRGBA(x, y, framebuffer.RGB565(v.palette[v.frame[y][x]]))
+		}
+	}
+	return img
+}
+
+func (v *Video) WritePNG(w io.Writer) error {
+	return png.Encode(w, v.Image())
+}
+
+func (v *Video) SavePNG(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := v.WritePNG(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,119 @@
+package watchdog
+
+import (
+	"code/g16/cpu"
+	"code/g16/pins"
+	"log"
+)
+
+const WATCHDOG_ADDRESS = 0xE900
+const WATCHDOG_SIZE = 0x0A
+
+const ( // Register offsets from WATCHDOG_ADDRESS, one word each
+	WATCHDOG_CONTROL = 0x00
+	WATCHDOG_TIMEOUT = 0x02 // Device cycles allowed between kicks
+	WATCHDOG_KICK    = 0x04 // Write KICK_KEY to restart the countdown
+	WATCHDOG_COUNT   = 0x06 // Device cycles left before the watchdog fires, read-only
+	WATCHDOG_STATUS  = 0x08 // Write 1s to clear
+)
+
+const (
+	CONTROL_ENABLE uint16 = 1 << 0
+	CONTROL_NMI    uint16 = 1 << 1 // Raise an NMI instead of resetting the CPU
+	STATUS_FIRED   uint16 = 1 << 0 // The watchdog has timed out since this was last cleared
+)
+
+const KICK_KEY = 0x5A5A
+const DEFAULT_TIMEOUT = 10000 // Device cycles
+
+type Watchdog struct {
+	Pins     *pins.Pins
+	ResetCPU func(cause cpu.ResetCause)
+	Timeout  uint16 // Value TIMEOUT takes on Reset
+	Fired    uint64 // Number of timeouts, for the host to inspect
+	control  uint16
+	timeout  uint16
+	count    uint16
+	status   uint16
+}
+
+func (w *Watchdog) Reset() {
+	if w.Timeout == 0 {
+		w.Timeout = DEFAULT_TIMEOUT
+	}
+	w.control = 0
+	w.timeout = w.Timeout
+	w.count = w.timeout
+	w.Pins.NMI = false
+}
+
+func (w *Watchdog) ProcessCycle() {
+	w.tick()
+
+	if !w.Pins.Valid {
+		return
+	}
+
+	reg := w.Pins.Address - WATCHDOG_ADDRESS
+	if w.Pins.RW { // Read
+		switch reg {
+		case WATCHDOG_CONTROL:
+			w.Pins.Data = w.control
+		case WATCHDOG_TIMEOUT:
+			w.Pins.Data = w.timeout
+		case WATCHDOG_COUNT:
+			w.Pins.Data = w.count
+		case WATCHDOG_STATUS:
+			w.Pins.Data = w.status
+		default:
+			log.Printf("Watchdog: read from unmapped register %02X\n", reg)
+			w.Pins.Data = 0
+		}
+	} else { // Write
+		switch reg {
+		case WATCHDOG_CONTROL:
+			if w.control&CONTROL_ENABLE == 0 && w.Pins.Data&CONTROL_ENABLE != 0 {
+				w.count = w.timeout
+			}
+			w.control = w.Pins.Data
+		case WATCHDOG_TIMEOUT:
+			w.timeout = w.Pins.Data
+		case WATCHDOG_KICK:
+			if w.Pins.Data == KICK_KEY {
+				w.count = w.timeout
+			} else {
+				log.Printf("Watchdog: kick with wrong key %04X ignored\n", w.Pins.Data)
+			}
+		case WATCHDOG_STATUS:
+			w.status &^= w.Pins.Data
+		default:
+			log.Printf("Watchdog: write %04X to read-only register %02X ignored\n", w.Pins.Data, reg)
+		}
+		w.Pins.Valid = false
+	}
+}
+
+// tick counts down towards a timeout. The NMI is a one-cycle pulse so that
+// every timeout gives the CPU a fresh edge.
+func (w *Watchdog) tick() {
+	w.Pins.NMI = false
+	if w.control&CONTROL_ENABLE == 0 {
+		return
+	}
+	if w.count > 0 {
+		w.count--
+		return
+	}
+
+	w.Fired++
+	w.status |= STATUS_FIRED
+	w.count = w.timeout
+	if w.control&CONTROL_NMI != 0 {
+		log.Printf("Watchdog: timed out, raising NMI\n")
+		w.Pins.NMI = true
+		return
+	}
+	log.Printf("Watchdog: timed out, resetting CPU\n")
+	w.control = 0 // Software has to re-arm the watchdog after a reset
+	w.ResetCPU(cpu.WatchdogReset)
+}